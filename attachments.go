@@ -0,0 +1,141 @@
+package imessage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// Attachment is a file attached to an incoming message.
+type Attachment struct {
+	Path         string `json:"path"`          // Path is the absolute path to the file on disk.
+	MimeType     string `json:"mime_type"`     // MimeType is the file type, like image/jpeg. May be empty.
+	TransferName string `json:"transfer_name"` // TransferName is the original name of the file.
+	// Saved is where SaveAttachments copied the file. Empty if it was not copied.
+	Saved string `json:"saved,omitempty"`
+}
+
+// SaveAttachments copies the message's attachments into dir, which is created if needed.
+// macOS may delete files in ~/Library/Messages/Attachments, so copy them right away to keep
+// them. Files are named for the message GUID, their position, and their original name.
+// Returns the new paths, and sets Saved on each attachment that was copied.
+func (msg Incoming) SaveAttachments(dir string) ([]string, error) {
+	if len(msg.Files) == 0 {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil { //nolint:gomnd
+		return nil, fmt.Errorf("creating attachment dir: %w", err)
+	}
+
+	prefix := msg.GUID
+	if prefix == "" {
+		prefix = strconv.FormatInt(msg.RowID, 10) //nolint:gomnd
+	}
+
+	saved := make([]string, 0, len(msg.Files))
+
+	for i, file := range msg.Files {
+		name := file.TransferName
+		if name == "" {
+			name = file.Path
+		}
+
+		path := filepath.Join(dir, fmt.Sprintf("%s-%d-%s", prefix, i+1, filepath.Base(name)))
+		if err := copyFile(file.Path, path); err != nil {
+			return saved, err
+		}
+
+		file.Saved = path
+		saved = append(saved, path)
+	}
+
+	return saved, nil
+}
+
+// copyFile copies the file at src to dst, replacing dst if it exists.
+func copyFile(src, dst string) error {
+	input, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("opening attachment: %w", err)
+	}
+	defer input.Close()
+
+	output, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("creating attachment copy: %w", err)
+	}
+
+	if _, err = io.Copy(output, input); err != nil {
+		_ = output.Close()
+		return fmt.Errorf("copying attachment: %w", err)
+	}
+
+	if err := output.Close(); err != nil {
+		return fmt.Errorf("copying attachment: %w", err)
+	}
+
+	return nil
+}
+
+// getAttachments returns the attachments for a message row id.
+// The database connection must already be open and locked.
+func (m *Messages) getAttachments(dbase *sqlite.Conn, rowID int64) []*Attachment {
+	sql := `SELECT attachment.filename AS filename, attachment.mime_type AS mime_type, ` +
+		`attachment.transfer_name AS transfer_name FROM attachment ` +
+		`INNER JOIN message_attachment_join ON message_attachment_join.attachment_id = attachment.ROWID ` +
+		`WHERE message_attachment_join.message_id = $id ORDER BY attachment.ROWID ASC`
+
+	query, _, err := dbase.PrepareTransient(sql)
+	if err != nil {
+		m.checkErr(err, ErrorDatabase, sql)
+		return nil
+	}
+
+	query.SetInt64("$id", rowID)
+
+	files := []*Attachment{}
+
+	for {
+		if hasRow, err := query.Step(); err != nil {
+			m.checkErr(err, ErrorDatabase, sql)
+			break
+		} else if !hasRow {
+			break
+		}
+
+		filename := strings.TrimSpace(query.GetText("filename"))
+		if filename == "" {
+			continue
+		}
+
+		files = append(files, &Attachment{
+			Path:         expandHome(filename),
+			MimeType:     strings.TrimSpace(query.GetText("mime_type")),
+			TransferName: strings.TrimSpace(query.GetText("transfer_name")),
+		})
+	}
+
+	m.checkErr(query.Finalize(), ErrorDatabase, "query reset")
+
+	return files
+}
+
+// expandHome turns a path like ~/Library/Messages into an absolute path.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
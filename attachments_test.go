@@ -0,0 +1,27 @@
+package imessage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandHome(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	tests := []struct {
+		in, want string
+	}{
+		{`~`, home},
+		{`~/My Photos/img "final".png`, filepath.Join(home, `My Photos/img "final".png`)},
+		{`~other/file.png`, `~other/file.png`},
+		{`/tmp/~/file.png`, `/tmp/~/file.png`},
+		{`relative/file.png`, `relative/file.png`},
+	}
+
+	for _, test := range tests {
+		if got := expandHome(test.in); got != test.want {
+			t.Errorf("expandHome(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
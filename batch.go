@@ -0,0 +1,163 @@
+package imessage
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// batchOK is the result line for a message in a batch that sent successfully.
+const batchOK = "ok"
+
+// ErrBatchResult is returned in a Response when a batch script finished without a result for the
+// message. It may have been sent, so it is not sent again.
+var ErrBatchResult = fmt.Errorf("no result for message in batch")
+
+// collectBatch gathers queued messages into a batch, starting with first.
+// Messages already in the queue are taken first, in priority order. Then it
+// returns when the batch is full, BatchWait elapses, or outChan is closed.
+func (m *Messages) collectBatch(first Outgoing, outChan <-chan Outgoing) []Outgoing {
+	batch := []Outgoing{first}
+
+	for len(batch) < m.BatchSize {
+		msg, ok := m.queue.pop()
+		if !ok {
+			break
+		}
+
+		batch = append(batch, msg)
+	}
+
+	timer := m.Clock.NewTimer(m.BatchWait)
+
+	defer timer.Stop()
+
+	for len(batch) < m.BatchSize {
+		select {
+		case msg, ok := <-outChan:
+			if !ok {
+				return batch
+			}
+
+			batch = append(batch, msg)
+		case <-timer.Chan():
+			return batch
+		}
+	}
+
+	return batch
+}
+
+// sendBatch sends several messages with one osascript run. Each send is wrapped in
+// a try block, and the script returns one result line per message, so every message
+// gets its own Response. Messages that can not be batched (like ShowTyping or Status)
+// are sent alone, in queue order, between the batched messages around them.
+func (m *Messages) sendBatch(batch []Outgoing) {
+	var (
+		run     = make([]Outgoing, 0, len(batch))
+		scripts = make([]string, 0, len(batch))
+	)
+
+	for _, msg := range batch {
+		if msg.drivesUI() || msg.Status != nil {
+			m.runBatch(run, scripts)
+			run, scripts = run[:0], scripts[:0]
+			m.finishSend(msg, m.sendiMessage(msg))
+
+			continue
+		}
+
+		// Messages that cannot be sent (like missing files) fail now and are left out of the batch.
+		script, errs := msg.sendScript()
+		if errs != nil {
+			m.finishSend(msg, msg.response(errs...))
+			continue
+		}
+
+		run = append(run, msg)
+		scripts = append(scripts, script)
+	}
+
+	m.runBatch(run, scripts)
+}
+
+// runBatch runs the send scripts for a batch of messages once. The batch is not retried,
+// because some of its messages may have been sent. The results are only returned when the
+// script finishes, so if it fails, nothing is known about any message and every one fails.
+// Messages the finished script reported an error for are sent again individually, with retries.
+func (m *Messages) runBatch(batch []Outgoing, scripts []string) {
+	switch len(batch) {
+	case 0:
+		return
+	case 1:
+		m.finishSend(batch[0], m.sendiMessage(batch[0]))
+		return
+	}
+
+	m.DebugLog.Printf("sending batch of %d messages", len(batch))
+
+	arg := []string{`set results to ""`}
+
+	for i := range batch {
+		idx := strconv.Itoa(i)
+		arg = append(arg,
+			`try`,
+			scripts[i],
+			`set results to results & "`+idx+` `+batchOK+`" & linefeed`,
+			`on error errMsg`,
+			`set results to results & "`+idx+` " & errMsg & linefeed`,
+			`end try`,
+		)
+	}
+
+	arg = append(arg, `tell application "Messages" to close every window`, `return results`)
+	start := m.Clock.Now()
+	stdout, output, sent, errs := m.runAppleScript(arg, 1)
+	elapsed := m.since(start)
+	// Messages can go out so quickly we need to sleep a bit to avoid sending duplicates.
+	m.Clock.Sleep(m.sendDelay())
+
+	results := parseBatchOutput(stdout)
+	if !sent {
+		m.DebugLog.Printf("batch of %d messages failed, not resending: %v", len(batch), errs)
+	}
+
+	for i, msg := range batch {
+		response := msg.response()
+		response.Elapsed, response.Output = elapsed, output
+		result, ok := results[i]
+
+		switch {
+		case !sent:
+			response.Errs = errs
+			m.finishSend(msg, response)
+		case m.DryRun, ok && result == batchOK:
+			response.Sent = true
+			m.finishSend(msg, response)
+		case !ok:
+			response.Errs = []error{ErrBatchResult}
+			m.finishSend(msg, response)
+		default:
+			m.DebugLog.Printf("batched message %s failed, sending individually: %s", msg.ID, result)
+			m.finishSend(msg, m.sendiMessage(msg))
+		}
+	}
+}
+
+// parseBatchOutput turns the result lines from a batch script into a map of index to result.
+func parseBatchOutput(output string) map[int]string {
+	results := make(map[int]string)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+
+	for scanner.Scan() {
+		//nolint:gomnd // index and result.
+		if split := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2); len(split) == 2 {
+			if idx, err := strconv.Atoi(split[0]); err == nil {
+				results[idx] = split[1]
+			}
+		}
+	}
+
+	return results
+}
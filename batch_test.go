@@ -0,0 +1,194 @@
+package imessage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var sendText = regexp.MustCompile(`send "([^"]*)"`)
+
+// batchRunner is a ScriptRunner that records the text of every message sent.
+// Batch scripts return result from their index; other scripts succeed.
+type batchRunner struct {
+	sync.Mutex
+	result    func(idx int) string
+	failAfter int      // Fail batch scripts after sending this many messages, if it's more than 0.
+	batches   int      // How many batch scripts ran.
+	sent      []string // Text of each message, in the order sent.
+}
+
+func (r *batchRunner) Run(_ context.Context, scripts []string) (string, string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	texts := sendText.FindAllStringSubmatch(strings.Join(scripts, "\n"), -1)
+
+	if !strings.HasPrefix(scripts[0], "set results") {
+		for _, text := range texts {
+			r.sent = append(r.sent, text[1])
+		}
+
+		return "", "", nil
+	}
+
+	r.batches++
+
+	if r.failAfter > 0 {
+		for _, text := range texts[:r.failAfter] {
+			r.sent = append(r.sent, text[1])
+		}
+
+		return "", "", fmt.Errorf("batch killed") //nolint:goerr113
+	}
+
+	var out string
+
+	for idx, text := range texts {
+		if result := r.result(idx); result == batchOK {
+			r.sent = append(r.sent, text[1])
+			out += fmt.Sprintf("%d %s\n", idx, result)
+		} else if result != "" {
+			out += fmt.Sprintf("%d %s\n", idx, result)
+		}
+	}
+
+	return out, out, nil
+}
+
+// sendTestBatch sends the batch with the runner, and returns every message's Response by ID.
+func sendTestBatch(t *testing.T, runner *batchRunner, batch []Outgoing) map[string]*Response {
+	t.Helper()
+
+	m := newTestMessages(t, &Config{Retries: 3, RetryDelay: time.Millisecond, SendDelay: time.Millisecond})
+	m.DryRun, m.Runner = false, runner
+
+	var (
+		lock      sync.Mutex
+		wg        sync.WaitGroup
+		responses = make(map[string]*Response)
+	)
+
+	for i := range batch {
+		wg.Add(1)
+
+		batch[i].ID = batch[i].Text
+		batch[i].Call = func(resp *Response) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			responses[resp.ID] = resp
+			wg.Done()
+		}
+	}
+
+	m.sendBatch(batch)
+	wg.Wait()
+
+	return responses
+}
+
+// Messages that can not be batched are sent between the batched messages around them.
+func TestSendBatchOrder(t *testing.T) {
+	t.Parallel()
+
+	runner := &batchRunner{result: func(int) string { return batchOK }}
+	sendTestBatch(t, runner, []Outgoing{
+		{To: "+15551234567", Text: "one"},
+		{To: "+15551234567", Text: "two"},
+		{To: "+15551234567", Text: "three", ShowTyping: true},
+		{To: "+15551234567", Text: "four"},
+		{To: "+15551234567", Text: "five"},
+	})
+
+	if expect := []string{"one", "two", "three", "four", "five"}; !reflect.DeepEqual(runner.sent, expect) {
+		t.Errorf("wrong send order: %q, expected %q", runner.sent, expect)
+	}
+
+	if runner.batches != 2 { //nolint:gomnd
+		t.Errorf("ran %d batches, expected 2", runner.batches)
+	}
+}
+
+// A batch is run once, and never sends a message twice. Only messages the finished
+// script reported an error for are sent again individually.
+func TestSendBatchFailed(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		runner *batchRunner
+		sent   []string // Messages with a Sent response.
+	}{
+		"script fails": {
+			runner: &batchRunner{failAfter: 1},
+		},
+		"no results": {
+			runner: &batchRunner{result: func(int) string { return "" }},
+		},
+		"some fail": {
+			runner: &batchRunner{result: func(idx int) string {
+				if idx == 1 {
+					return "error sending"
+				}
+
+				return batchOK
+			}},
+			sent: []string{"one", "three", "two"},
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			responses := sendTestBatch(t, test.runner, []Outgoing{
+				{To: "+15551234567", Text: "one"},
+				{To: "+15551234567", Text: "two"},
+				{To: "+15551234567", Text: "three"},
+			})
+
+			if test.runner.batches != 1 {
+				t.Errorf("ran %d batches, expected 1", test.runner.batches)
+			}
+
+			seen := make(map[string]bool)
+
+			for _, text := range test.runner.sent {
+				if seen[text] {
+					t.Errorf("%s was sent twice: %q", text, test.runner.sent)
+				}
+
+				seen[text] = true
+			}
+
+			var sent []string
+
+			for id, resp := range responses {
+				if resp.Sent {
+					sent = append(sent, id)
+				} else if len(resp.Errs) == 0 {
+					t.Errorf("%s was not sent, and has no error", id)
+				}
+			}
+
+			if !reflect.DeepEqual(sorted(sent), test.sent) {
+				t.Errorf("sent responses for %q, expected %q", sent, test.sent)
+			}
+		})
+	}
+}
+
+func sorted(list []string) []string {
+	out := append([]string(nil), list...)
+	sort.Strings(out)
+
+	return out
+}
@@ -0,0 +1,75 @@
+package imessage
+
+import (
+	"sync"
+)
+
+// BulkProgress is passed to the SendBulk progress function each time a message finishes.
+type BulkProgress struct {
+	Total    int       // Total is how many messages were queued.
+	Done     int       // Done is how many messages finished, sent or not.
+	Sent     int       // Sent is how many messages were sent.
+	Failed   int       // Failed is how many messages were not sent.
+	Response *Response // Response is for the message that just finished.
+}
+
+// SendBulk queues many messages at once. Unlike calling Send in a loop, this never waits for
+// room in the outgoing channel; the messages go right into the queue. They are sent in order,
+// by Priority. Set BatchSize to send several messages with each osascript run. Each message's
+// Call function still runs. If progress is not nil, it runs after each message finishes, one
+// call at a time, so a caller can track a broadcast. Returns ErrStopped if the library was
+// stopped, or ErrQueueFull if the messages would go over MaxQueueDepth; nothing is queued.
+func (m *Messages) SendBulk(msgs []Outgoing, progress func(BulkProgress)) error {
+	m.outLock.RLock()
+	defer m.outLock.RUnlock()
+
+	if m.outShut {
+		return ErrStopped
+	} else if m.MaxQueueDepth > 0 && m.queueDepth()+len(msgs) > m.MaxQueueDepth {
+		return ErrQueueFull
+	}
+
+	var (
+		lock   sync.Mutex
+		status = BulkProgress{Total: len(msgs)}
+	)
+
+	for _, msg := range msgs {
+		msg = m.prepare(msg)
+
+		if callback := msg.Call; progress != nil {
+			msg.Call = func(resp *Response) {
+				if callback != nil {
+					callback(resp)
+				}
+
+				lock.Lock()
+				defer lock.Unlock()
+
+				status.Done++
+				if resp.Sent {
+					status.Sent++
+				} else {
+					status.Failed++
+				}
+
+				status.Response = resp
+				progress(status)
+			}
+		}
+
+		m.queue.push(msg)
+	}
+
+	return nil
+}
+
+// SendToAll sends the same text to every recipient in to, with SendBulk.
+func (m *Messages) SendToAll(to []string, text string, progress func(BulkProgress)) error {
+	msgs := make([]Outgoing, len(to))
+	for i, recipient := range to {
+		msgs[i] = Outgoing{To: recipient, Text: text}
+	}
+
+	return m.SendBulk(msgs, progress)
+}
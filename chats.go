@@ -0,0 +1,223 @@
+package imessage
+
+import (
+	"fmt"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// ErrChatNotFound is returned when a chat GUID is not in the database.
+var ErrChatNotFound = fmt.Errorf("chat not found")
+
+// Chat is a conversation in the database, returned by Chats().
+type Chat struct {
+	ID         int64  `json:"id"`         // ID is the chat's row id. Incoming.ChatID matches this.
+	GUID       string `json:"guid"`       // GUID is the unique chat identifier, like Incoming.ChatGUID.
+	Identifier string `json:"identifier"` // Identifier is the handle (one-on-one) or chat id (group).
+	Name       string `json:"name"`       // Name is the display name of a named group chat.
+	Service    string `json:"service"`    // Service is iMessage or SMS.
+	Group      bool   `json:"group"`      // Group is true for group chats.
+	// Participants are the handles of everyone in the chat, except this account.
+	Participants []string `json:"participants"`
+}
+
+// Chats returns every chat in the database with its participants, oldest chat first.
+//
+//nolint:wrapcheck
+func (m *Messages) Chats() ([]Chat, error) {
+	sql := `SELECT chat.ROWID AS id, chat.guid AS guid, chat.chat_identifier AS identifier, ` +
+		`chat.display_name AS name, chat.service_name AS service, ` +
+		`GROUP_CONCAT(handle.id, char(10)) AS participants FROM chat ` +
+		`LEFT JOIN chat_handle_join ON chat_handle_join.chat_id = chat.ROWID ` +
+		`LEFT JOIN handle ON handle.ROWID = chat_handle_join.handle_id ` +
+		`GROUP BY chat.ROWID ORDER BY chat.ROWID ASC`
+
+	dbase, err := m.getDB()
+	if err != nil {
+		return nil, err
+	}
+
+	defer m.closeDB(dbase)
+
+	query, _, err := dbase.PrepareTransient(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	var chats []Chat
+
+	err = m.stepRows(query, func(query *sqlite.Stmt) {
+		chats = chats[:0]
+	}, func(query *sqlite.Stmt) {
+		chat := Chat{
+			ID:           query.GetInt64("id"),
+			GUID:         strings.TrimSpace(query.GetText("guid")),
+			Identifier:   strings.TrimSpace(query.GetText("identifier")),
+			Name:         strings.TrimSpace(query.GetText("name")),
+			Service:      strings.TrimSpace(query.GetText("service")),
+			Participants: []string{},
+		}
+		chat.Group = strings.Contains(chat.GUID, ";+;")
+
+		for _, handle := range strings.Split(query.GetText("participants"), "\n") {
+			if handle = strings.TrimSpace(handle); handle != "" {
+				chat.Participants = append(chat.Participants, m.normalizeHandle(handle))
+			}
+		}
+
+		chats = append(chats, chat)
+	})
+	if err != nil {
+		m.checkErr(err, ErrorDatabase, sql)
+		return nil, err
+	}
+
+	return chats, nil
+}
+
+// MarkRead marks a conversation as read by opening it in Messages.app, then closes
+// every window like Send does. Pass in the ChatGUID from an Incoming message.
+// Only one-on-one chats are supported, because AppleScript cannot open a group chat.
+func (m *Messages) MarkRead(chatGUID string) error {
+	openChat, err := openChatScript(chatGUID)
+	if err != nil {
+		return err
+	}
+
+	if exists, err := m.chatExists(chatGUID); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("%w: %s", ErrChatNotFound, chatGUID)
+	}
+
+	arg := append(openChat, `delay 1`, `tell application "Messages" to close every window`)
+	if sent, errs := m.RunAppleScript(arg); !sent && len(errs) > 0 {
+		return errs[0]
+	}
+
+	m.Clock.Sleep(m.SendDelay)
+
+	return nil
+}
+
+// ClearConversation deletes one conversation from Messages.app. This can not be undone.
+// Pass in a ChatGUID from an Incoming message or Chats(). Returns ErrChatNotFound if
+// the chat is not in the database.
+func (m *Messages) ClearConversation(chatGUID string) error {
+	if exists, err := m.chatExists(chatGUID); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("%w: %s", ErrChatNotFound, chatGUID)
+	}
+
+	arg := `tell application "Messages"
+	activate
+	delete chat id "` + escapeAppleScript(chatGUID) + `"
+	tell application "System Events" to tell process "Messages" to keystroke return
+	close every window
+end tell
+`
+	if sent, errs := m.RunAppleScript([]string{arg}); !sent && len(errs) > 0 {
+		return errs[0]
+	}
+
+	m.Clock.Sleep(m.SendDelay)
+
+	return nil
+}
+
+// openChatScript returns an AppleScript that brings a one-on-one chat to the front.
+// Returns ErrUnsupportedChat for group chats and malformed GUIDs.
+func openChatScript(chatGUID string) ([]string, error) {
+	parts := strings.SplitN(chatGUID, ";", 3) //nolint:gomnd
+	if len(parts) != 3 || parts[1] != "-" || parts[2] == "" {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedChat, chatGUID)
+	}
+
+	url := "imessage://"
+	if strings.EqualFold(parts[0], ServiceSMS) {
+		url = "sms:"
+	}
+
+	return []string{
+		`tell application "Messages" to activate`,
+		`open location "` + url + escapeAppleScript(parts[2]) + `"`,
+	}, nil
+}
+
+// chatGUID returns the GUID of the one-on-one chat with a handle, from the database.
+// A chat on the provided service is preferred over one on another service (SMS or iMessage).
+// Chat GUIDs are returned unchanged, and a handle without a chat gets a GUID on the service.
+//
+//nolint:wrapcheck
+func (m *Messages) chatGUID(to, service string) (string, error) {
+	if isChatGUID(to) {
+		return to, nil
+	}
+
+	sql := `SELECT guid FROM chat WHERE chat_identifier = $handle AND guid LIKE '%;-;%' ` +
+		`ORDER BY service_name = $service DESC, ROWID DESC LIMIT 1`
+
+	dbase, err := m.getDB()
+	if err != nil {
+		return "", err
+	}
+
+	defer m.closeDB(dbase)
+
+	query, _, err := dbase.PrepareTransient(sql)
+	if err != nil {
+		return "", err
+	}
+
+	handle := m.normalizeHandle(to)
+	query.SetText("$handle", handle)
+	query.SetText("$service", service)
+
+	hasRow, err := query.Step()
+	if err != nil {
+		m.checkErr(err, ErrorDatabase, sql)
+		_ = query.Finalize()
+
+		return "", err
+	}
+
+	guid := service + ";-;" + handle
+	if hasRow {
+		guid = strings.TrimSpace(query.GetText("guid"))
+	}
+
+	return guid, query.Finalize()
+}
+
+// chatExists returns true if the chat GUID is in the database.
+//
+//nolint:wrapcheck
+func (m *Messages) chatExists(chatGUID string) (bool, error) {
+	sql := `SELECT ROWID FROM chat WHERE guid = $guid`
+
+	dbase, err := m.getDB()
+	if err != nil {
+		return false, err
+	}
+
+	defer m.closeDB(dbase)
+
+	query, _, err := dbase.PrepareTransient(sql)
+	if err != nil {
+		return false, err
+	}
+
+	query.SetText("$guid", chatGUID)
+
+	hasRow, err := query.Step()
+	if err != nil {
+		m.checkErr(err, ErrorDatabase, sql)
+		_ = query.Finalize()
+
+		return false, err
+	}
+
+	return hasRow, query.Finalize()
+}
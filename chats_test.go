@@ -0,0 +1,104 @@
+package imessage
+
+import (
+	"testing"
+	"time"
+)
+
+// Handles are looked up in the database, so SMS chats and chats on newer macOS are found.
+func TestChatGUID(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{})
+	execTestDB(t, m.SQLPath, `INSERT INTO chat (guid, style, chat_identifier, service_name)
+		VALUES ('SMS;-;+15557654321', 45, '+15557654321', 'SMS'),
+		('SMS;-;+15551234567', 45, '+15551234567', 'SMS'),
+		('any;-;carol@example.com', 45, 'carol@example.com', 'iMessage')`)
+
+	tests := []struct{ to, service, expect string }{
+		{"+15551234567", ServiceIMessage, "iMessage;-;+15551234567"},
+		{"+15551234567", ServiceSMS, "SMS;-;+15551234567"},
+		{"+15557654321", ServiceIMessage, "SMS;-;+15557654321"},
+		{"carol@example.com", ServiceIMessage, "any;-;carol@example.com"},
+		{"dave@example.com", ServiceIMessage, "iMessage;-;dave@example.com"},
+		{"iMessage;+;chat123", ServiceIMessage, "iMessage;+;chat123"},
+	}
+
+	for _, test := range tests {
+		if guid, err := m.chatGUID(test.to, test.service); err != nil || guid != test.expect {
+			t.Errorf("chat for %s on %s: got %q and error %v, expected %q", test.to, test.service, guid, err, test.expect)
+		}
+	}
+}
+
+func TestOpenChatScript(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"iMessage;-;+15551234567": `open location "imessage://+15551234567"`,
+		"any;-;bob@example.com":   `open location "imessage://bob@example.com"`,
+		"SMS;-;+15551234567":      `open location "sms:+15551234567"`,
+	}
+
+	for guid, expect := range tests {
+		if script, err := openChatScript(guid); err != nil || script[1] != expect {
+			t.Errorf("%s: got %q and error %v, expected %q", guid, script, err, expect)
+		}
+	}
+
+	if _, err := openChatScript("iMessage;+;chat123"); err == nil {
+		t.Errorf("group chats can not be opened, but no error was returned")
+	}
+}
+
+// Messages that drive the user interface open the chat the handle already has, even on SMS.
+func TestSendiMessageChat(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]Outgoing{
+		"reaction": {To: "+15557654321", Text: "!like", ReactTo: -1},
+		"typing":   {To: "+15557654321", Text: "hi", ShowTyping: true},
+		"effect":   {To: "+15557654321", Text: "hi", Effect: "lasers"},
+		"reply":    {To: "+15557654321", Text: "hi", ReplyTo: "target"},
+	}
+
+	for name, msg := range tests {
+		msg := msg
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			m := newTestMessages(t, &Config{SendDelay: time.Millisecond})
+			runner := &scriptsRunner{}
+			m.DryRun, m.Runner = false, runner
+
+			execTestDB(t, m.SQLPath, `INSERT INTO chat (guid, style, chat_identifier, service_name)
+				VALUES ('SMS;-;+15557654321', 45, '+15557654321', 'SMS')`)
+
+			if id := addTestMessage(t, m.SQLPath, 1, 3, "hi", 1); msg.ReactTo != 0 { //nolint:gomnd
+				msg.ReactTo = id
+			}
+
+			execTestDB(t, m.SQLPath, `UPDATE message SET guid = 'target'`)
+
+			if resp := m.sendiMessage(msg); !resp.Sent {
+				t.Fatalf("message was not sent: %v", resp.Errs)
+			}
+
+			if len(runner.runs) != 1 || !hasScript(runner.runs[0], `open location "sms:+15557654321"`) {
+				t.Errorf("scripts did not open the SMS chat: %q", runner.runs)
+			}
+		})
+	}
+}
+
+// hasScript returns true if one of the scripts is script.
+func hasScript(scripts []string, script string) bool {
+	for _, s := range scripts {
+		if s == script {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,49 @@
+package imessage
+
+import "time"
+
+// Clock tells time for the library: every sleep, timer and ticker goes through it.
+// The default is the system clock. Tests can set Config.Clock to a fake one to control
+// debouncing, retries, send delays and polling without waiting for real time to pass.
+// Script timeouts (Config.Timeout) and contexts passed in by the caller use the system clock.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker is returned by Clock.NewTicker. It works like a *time.Ticker.
+type Ticker interface {
+	Chan() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// Timer is returned by Clock.NewTimer. It works like a *time.Timer.
+type Timer interface {
+	Chan() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// systemClock is the default Clock. It uses the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                   { return time.Now() }
+func (systemClock) Sleep(d time.Duration)            { time.Sleep(d) }
+func (systemClock) NewTicker(d time.Duration) Ticker { return systemTicker{time.NewTicker(d)} }
+func (systemClock) NewTimer(d time.Duration) Timer   { return systemTimer{time.NewTimer(d)} }
+
+type systemTicker struct{ *time.Ticker }
+
+func (t systemTicker) Chan() <-chan time.Time { return t.C }
+
+type systemTimer struct{ *time.Timer }
+
+func (t systemTimer) Chan() <-chan time.Time { return t.C }
+
+// since returns the time passed since start, according to the Clock.
+func (m *Messages) since(start time.Time) time.Duration {
+	return m.Clock.Now().Sub(start)
+}
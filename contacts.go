@@ -0,0 +1,116 @@
+package imessage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"crawshaw.io/sqlite"
+)
+
+// addressBookTTL is how long the contact names are cached before the AddressBook is read again.
+const addressBookTTL = 10 * time.Minute
+
+// addressBookGlobs find the AddressBook databases, relative to the home directory.
+// Contacts synced from iCloud (and other accounts) are in the Sources folders.
+//
+//nolint:gochecknoglobals
+var addressBookGlobs = []string{
+	"Library/Application Support/AddressBook/AddressBook-v22.abcddb",
+	"Library/Application Support/AddressBook/Sources/*/AddressBook-v22.abcddb",
+}
+
+// contacts caches the handle to name mapping from the AddressBook database(s).
+type contacts struct {
+	names  map[string]string // normalized handle -> display name.
+	loaded time.Time
+	sync.Mutex
+}
+
+// contactName returns the AddressBook name for a handle, or an empty string if
+// ResolveNames is disabled or the handle is not a known contact.
+func (m *Messages) contactName(handle string) string {
+	if !m.ResolveNames || handle == "" {
+		return ""
+	}
+
+	m.contacts.Lock()
+	defer m.contacts.Unlock()
+
+	if m.contacts.names == nil || m.since(m.contacts.loaded) > addressBookTTL {
+		m.contacts.names = m.loadContacts()
+		m.contacts.loaded = m.Clock.Now()
+	}
+
+	return m.contacts.names[NormalizeHandle(handle, m.CountryCode)]
+}
+
+// loadContacts reads every phone number and email address from the AddressBook database(s).
+func (m *Messages) loadContacts() map[string]string {
+	names := make(map[string]string)
+
+	for _, path := range m.addressBookPaths() {
+		m.DebugLog.Println("reading address book:", path)
+
+		dbase, err := openDB(path)
+		if err != nil {
+			m.checkErr(err, ErrorDatabase, "opening address book: "+path)
+			continue
+		}
+
+		m.readContacts(dbase, names)
+		m.checkErr(dbase.Close(), ErrorDatabase, "closing address book: "+path)
+	}
+
+	return names
+}
+
+// addressBookPaths returns the AddressBookPath from the config, or finds them in the home folder.
+func (m *Messages) addressBookPaths() []string {
+	if m.AddressBookPath != "" {
+		return []string{m.AddressBookPath}
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+
+	var paths []string
+
+	for _, glob := range addressBookGlobs {
+		found, _ := filepath.Glob(filepath.Join(home, glob))
+		paths = append(paths, found...)
+	}
+
+	return paths
+}
+
+// readContacts adds the phone numbers and email addresses from an AddressBook database to names.
+func (m *Messages) readContacts(dbase *sqlite.Conn, names map[string]string) {
+	const name = `TRIM(COALESCE(NULLIF(TRIM(COALESCE(r.ZFIRSTNAME, '') || ' ' || COALESCE(r.ZLASTNAME, '')), ''), ` +
+		`r.ZNICKNAME, r.ZORGANIZATION, '')) AS name`
+
+	for _, sql := range []string{
+		`SELECT p.ZFULLNUMBER AS handle, ` + name + ` FROM ZABCDPHONENUMBER p ` +
+			`INNER JOIN ZABCDRECORD r ON p.ZOWNER = r.Z_PK`,
+		`SELECT e.ZADDRESS AS handle, ` + name + ` FROM ZABCDEMAILADDRESS e ` +
+			`INNER JOIN ZABCDRECORD r ON e.ZOWNER = r.Z_PK`,
+	} {
+		query, _, err := dbase.PrepareTransient(sql)
+		if err != nil {
+			m.checkErr(err, ErrorDatabase, sql)
+			continue
+		}
+
+		err = m.stepRows(query, func(*sqlite.Stmt) {}, func(query *sqlite.Stmt) {
+			handle := NormalizeHandle(query.GetText("handle"), m.CountryCode)
+			if name := strings.TrimSpace(query.GetText("name")); handle != "" && name != "" {
+				names[handle] = name
+			}
+		})
+		m.checkErr(err, ErrorDatabase, sql)
+	}
+}
@@ -0,0 +1,102 @@
+package imessage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// cursor holds the current ID of every database, as saved to CursorFile.
+type cursor struct {
+	ids map[string]int64 // database path -> current ID.
+	sync.Mutex
+}
+
+// loadCursor reads CursorFile, and resumes each database from its saved ID.
+// Databases that are not in the file (or a missing file) start after the newest message.
+func (m *Messages) loadCursor() error {
+	if m.CursorFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(m.CursorFile)
+	if os.IsNotExist(err) {
+		m.DebugLog.Printf("cursor file %s does not exist yet", m.CursorFile)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading cursor file: %w", err)
+	}
+
+	ids := make(map[string]int64)
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return fmt.Errorf("decoding cursor file %s: %w", m.CursorFile, err)
+	}
+
+	for _, src := range m.sources {
+		id, ok := ids[src.path]
+		if !ok {
+			continue
+		}
+
+		src.idLock.Lock()
+		if !src.resume { // SetCurrentID wins.
+			src.currentID = id
+			src.resume = true
+		}
+		src.idLock.Unlock()
+	}
+
+	return nil
+}
+
+// saveCursor writes a database's current ID to CursorFile. The file is replaced
+// atomically, so a crash never leaves a partial file behind.
+func (m *Messages) saveCursor(path string, id int64) {
+	if m.CursorFile == "" {
+		return
+	}
+
+	m.cursor.Lock()
+	defer m.cursor.Unlock()
+
+	if m.cursor.ids == nil {
+		m.cursor.ids = make(map[string]int64)
+	}
+
+	m.cursor.ids[path] = id
+
+	data, err := json.Marshal(m.cursor.ids)
+	if err != nil {
+		m.checkErr(err, ErrorDatabase, "encoding cursor")
+		return
+	}
+
+	m.checkErr(writeFileAtomic(m.CursorFile, data), ErrorDatabase, "writing cursor file")
+}
+
+// writeFileAtomic writes a temporary file next to path, then renames it to path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+
+	defer os.Remove(tmp.Name()) // fails after a successful rename.
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("writing temp file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing temp file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("renaming temp file: %w", err)
+	}
+
+	return nil
+}
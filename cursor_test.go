@@ -0,0 +1,74 @@
+package imessage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readTestCursor returns the ID saved for path in the cursor file, or 0.
+func readTestCursor(t *testing.T, file, path string) int64 {
+	t.Helper()
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]int64)
+	if err := json.Unmarshal(data, &ids); err != nil {
+		t.Fatal(err)
+	}
+
+	return ids[path]
+}
+
+// The cursor never moves past a message that was not handled yet.
+func TestCursorAfterHandled(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{CursorFile: filepath.Join(t.TempDir(), "cursor.json")})
+	handled := make(chan Incoming)
+
+	if err := m.IncomingChan(".*", handled); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan Incoming, 4) //nolint:gomnd
+	for id := int64(1); id <= 3; id++ {
+		messages <- Incoming{RowID: id, Source: m.SQLPath, Text: "hello"}
+	}
+
+	messages <- Incoming{RowID: 1, Source: m.SQLPath, Text: "edited", Edited: true}
+	close(messages)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		m.processIncomingMessages(messages)
+	}()
+
+	for id := int64(1); id <= 3; id++ {
+		if saved := readTestCursor(t, m.CursorFile, m.SQLPath); saved >= id {
+			t.Errorf("cursor is %d before message %d was handled", saved, id)
+		}
+
+		select {
+		case <-handled:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("message %d was not handled", id)
+		}
+	}
+
+	<-handled // The edit.
+	<-done
+
+	if saved := readTestCursor(t, m.CursorFile, m.SQLPath); saved != 3 { //nolint:gomnd
+		t.Errorf("cursor is %d after every message was handled, want 3", saved)
+	}
+}
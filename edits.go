@@ -0,0 +1,97 @@
+package imessage
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"crawshaw.io/sqlite"
+)
+
+// checkEdits returns messages that were edited or unsent since the last check, as
+// updates with Edited or Retracted set. Only messages delivered before this read (up
+// to delivered) are returned; newer messages were just delivered with their changes.
+// Messages are selected like new incoming messages, with IncomingFilter and
+// IncludeFromMe. The source must be locked.
+func (m *Messages) checkEdits(dbase *sqlite.Conn, src *source, delivered int64) []Incoming {
+	if src.noEdits {
+		return nil
+	}
+
+	if src.editsSince < 0 {
+		m.readEditsSince(dbase, src)
+		return nil
+	}
+
+	// Rows are read oldest change first, so after a busy retry the query restarts after
+	// the last change delivered, and a row is never delivered twice.
+	sql := messageSQL(m.incomingWhere(`message.rowid <= $id AND `+
+		`(message.date_edited > $since OR message.date_retracted > $since)`),
+		`MAX(message.date_edited, message.date_retracted) ASC, message.rowid ASC`,
+		`message.date_edited as date_edited`, `message.date_retracted as date_retracted`)
+
+	query, sql, err := m.prepareMessages(dbase, sql, &src.noReplies)
+	if err != nil {
+		m.checkErr(err, ErrorDatabase, sql)
+		return nil
+	}
+
+	var (
+		since    = src.editsSince // Edited and Retracted are changes after this.
+		messages []Incoming
+	)
+
+	err = m.stepRows(query, func(query *sqlite.Stmt) {
+		query.SetInt64("$id", src.currentID)
+		query.SetInt64("$since", src.editsSince)
+		bindParams(query, m.IncomingParams)
+	}, func(query *sqlite.Stmt) {
+		msg := m.scanMessage(dbase, query)
+		msg.Source = src.path
+
+		for _, date := range []int64{query.GetInt64("date_edited"), query.GetInt64("date_retracted")} {
+			if date > src.editsSince {
+				src.editsSince = date
+			}
+		}
+
+		msg.Edited = query.GetInt64("date_edited") > since
+		msg.Retracted = query.GetInt64("date_retracted") > since
+
+		if msg.RowID > delivered {
+			return // Read as a new message with this change; editsSince still moves past it.
+		}
+
+		if m.ignored[NormalizeHandle(msg.RawFrom, m.CountryCode)] {
+			return
+		}
+
+		atomic.AddInt64(&m.stats.received, 1)
+
+		messages = append(messages, msg)
+	})
+	m.checkErr(err, ErrorDatabase, sql)
+
+	return messages
+}
+
+// readEditsSince sets the newest edit or unsend date in the database, so only
+// later edits are delivered. Databases without edit columns are not checked again.
+func (m *Messages) readEditsSince(dbase *sqlite.Conn, src *source) {
+	sql := `SELECT MAX(COALESCE(MAX(date_edited), 0), COALESCE(MAX(date_retracted), 0)) as since FROM message`
+
+	query, _, err := dbase.PrepareTransient(sql)
+	if err != nil && strings.Contains(err.Error(), "no such column") {
+		m.DebugLog.Printf("database has no edit columns, not checking for edits: %s", src.path)
+		src.noEdits = true
+
+		return
+	} else if err != nil {
+		m.checkErr(err, ErrorDatabase, sql)
+		return
+	}
+
+	err = m.stepRows(query, func(*sqlite.Stmt) {}, func(query *sqlite.Stmt) {
+		src.editsSince = query.GetInt64("since")
+	})
+	m.checkErr(err, ErrorDatabase, sql)
+}
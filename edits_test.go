@@ -0,0 +1,142 @@
+package imessage
+
+import (
+	"reflect"
+	"testing"
+)
+
+// checkTestEdits returns the edits in the test database since since, for messages up to id.
+func checkTestEdits(t *testing.T, m *Messages, id, since int64) []Incoming {
+	t.Helper()
+
+	src := m.primary()
+	src.currentID, src.editsSince = id, since
+
+	dbase, err := m.getDBPath(src.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.closeDB(dbase)
+
+	return m.checkEdits(dbase, src, id)
+}
+
+// Edits are selected like new messages: with IncomingFilter, IncomingParams and IncludeFromMe.
+func TestCheckEditsFilter(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config Config
+		expect []int64
+	}{
+		"default": {expect: []int64{1, 2}},
+		"from me": {config: Config{IncludeFromMe: true}, expect: []int64{1, 2, 3}},
+		"filtered": {
+			config: Config{IncomingFilter: `handle.id = $from`, IncomingParams: map[string]interface{}{"$from": "bob@example.com"}},
+			expect: []int64{2},
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			m := newTestMessages(t, &test.config)
+			addTestMessage(t, m.SQLPath, 1, 1, "one", 1)
+			addTestMessage(t, m.SQLPath, 2, 1, "two", 2)
+			addTestMessage(t, m.SQLPath, 1, 1, "three", 3)
+			execTestDB(t, m.SQLPath, `UPDATE message SET is_from_me = 1 WHERE rowid = 3;
+				UPDATE message SET date_edited = 100;`)
+
+			edits := checkTestEdits(t, m, 3, 0) //nolint:gomnd
+			if len(edits) != len(test.expect) {
+				t.Fatalf("got %d edits, expected %d: %v", len(edits), len(test.expect), edits)
+			}
+
+			for i, msg := range edits {
+				if msg.RowID != test.expect[i] || !msg.Edited || msg.Retracted {
+					t.Errorf("edit %d is message %d (edited %v, retracted %v), expected an edit of %d",
+						i, msg.RowID, msg.Edited, msg.Retracted, test.expect[i])
+				}
+			}
+		})
+	}
+}
+
+// Edits are read oldest change first, so a query restarted after the newest
+// change delivered (like after a busy retry) does not skip or repeat any.
+func TestCheckEditsOrder(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{})
+	for _, text := range []string{"one", "two", "three"} {
+		addTestMessage(t, m.SQLPath, 1, 1, text, 1)
+	}
+
+	execTestDB(t, m.SQLPath, `UPDATE message SET date_edited = 300 WHERE rowid = 1;
+		UPDATE message SET date_retracted = 100 WHERE rowid = 2;
+		UPDATE message SET date_edited = 200 WHERE rowid = 3;`)
+
+	edits := checkTestEdits(t, m, 3, 0) //nolint:gomnd
+
+	var got []int64
+	for _, msg := range edits {
+		got = append(got, msg.RowID)
+	}
+
+	if expect := []int64{2, 3, 1}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("edits delivered in order %v, expected %v", got, expect)
+	}
+
+	if !edits[0].Retracted || edits[0].Edited {
+		t.Errorf("message 2 was unsent, got edited %v retracted %v", edits[0].Edited, edits[0].Retracted)
+	}
+
+	if since := m.primary().editsSince; since != 300 { //nolint:gomnd
+		t.Errorf("editsSince = %d, expected 300", since)
+	}
+
+	// Restarting after the second change only returns the third.
+	if edits := checkTestEdits(t, m, 3, 200); len(edits) != 1 || edits[0].RowID != 1 { //nolint:gomnd
+		t.Errorf("edits after 200: %v, expected only message 1", edits)
+	}
+}
+
+// A message edited before it is first read is delivered once, as a new message,
+// and never again as an edit. Edits to messages read earlier are still delivered.
+func TestCheckEditsNewMessages(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{})
+	src := m.primary()
+
+	addTestMessage(t, m.SQLPath, 1, 1, "one", 1)
+
+	if got := m.readNewMessages(src); len(got) != 1 {
+		t.Fatalf("got %d messages, expected 1", len(got))
+	}
+
+	addTestMessage(t, m.SQLPath, 1, 1, "two", 2) //nolint:gomnd
+	execTestDB(t, m.SQLPath, `UPDATE message SET date_edited = 100 WHERE rowid = 1;
+		UPDATE message SET text = 'two, edited', date_edited = 200 WHERE rowid = 2;`)
+
+	var got []int64
+	for _, msg := range m.readNewMessages(src) {
+		if msg.Edited != (msg.RowID == 1) {
+			t.Errorf("message %d has edited %v", msg.RowID, msg.Edited)
+		}
+
+		got = append(got, msg.RowID)
+	}
+
+	if expect := []int64{2, 1}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("got messages %v, expected new message 2 and an edit of 1", got)
+	}
+
+	if again := m.readNewMessages(src); len(again) != 0 {
+		t.Errorf("got %d messages on the next read, expected none: %v", len(again), again)
+	}
+}
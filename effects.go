@@ -0,0 +1,130 @@
+package imessage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidEffect is returned in a Response when Outgoing.Effect is not a known effect.
+var ErrInvalidEffect = fmt.Errorf("invalid message effect")
+
+// effects maps Outgoing.Effect values to their names in the Messages.app effect picker.
+//
+//nolint:gochecknoglobals
+var effects = map[string]string{
+	// Bubble effects.
+	"slam":         "Slam",
+	"loud":         "Loud",
+	"gentle":       "Gentle",
+	"invisibleink": "Invisible Ink",
+	// Screen effects.
+	"balloons":     "Balloons",
+	"confetti":     "Confetti",
+	"echo":         "Echo",
+	"fireworks":    "Fireworks",
+	"lasers":       "Lasers",
+	"love":         "Love",
+	"celebration":  "Celebration",
+	"spotlight":    "Spotlight",
+	"shootingstar": "Shooting Star",
+}
+
+// styleEffects maps the database's expressive_send_style_id values to Outgoing.Effect values.
+//
+//nolint:gochecknoglobals
+var styleEffects = map[string]string{
+	"com.apple.MobileSMS.expressivesend.impact":       "slam",
+	"com.apple.MobileSMS.expressivesend.loud":         "loud",
+	"com.apple.MobileSMS.expressivesend.gentle":       "gentle",
+	"com.apple.MobileSMS.expressivesend.invisibleink": "invisibleink",
+	"com.apple.messages.effect.CKHappyBirthdayEffect": "balloons",
+	"com.apple.messages.effect.CKConfettiEffect":      "confetti",
+	"com.apple.messages.effect.CKEchoEffect":          "echo",
+	"com.apple.messages.effect.CKFireworksEffect":     "fireworks",
+	"com.apple.messages.effect.CKLasersEffect":        "lasers",
+	"com.apple.messages.effect.CKHeartEffect":         "love",
+	"com.apple.messages.effect.CKSparklesEffect":      "celebration",
+	"com.apple.messages.effect.CKSpotlightEffect":     "spotlight",
+	"com.apple.messages.effect.CKShootingStarEffect":  "shootingstar",
+}
+
+// styleEffect returns the Incoming.Effect for an expressive_send_style_id.
+func styleEffect(style string) string {
+	if effect, ok := styleEffects[style]; ok {
+		return effect
+	}
+
+	return strings.TrimSpace(style)
+}
+
+// Effects returns the values Outgoing.Effect accepts.
+func Effects() []string {
+	list := make([]string, 0, len(effects))
+	for effect := range effects {
+		list = append(list, effect)
+	}
+
+	sort.Strings(list)
+
+	return list
+}
+
+// effectName returns the effect picker name for an Outgoing.Effect value.
+// Case, spaces, dashes and underscores are ignored, so "Invisible Ink" works.
+func effectName(effect string) (string, error) {
+	key := strings.NewReplacer(" ", "", "-", "", "_", "").Replace(strings.ToLower(effect))
+	if name, ok := effects[key]; ok {
+		return name, nil
+	}
+
+	return "", fmt.Errorf("%w: %q, use one of: %s", ErrInvalidEffect, effect, strings.Join(Effects(), ", "))
+}
+
+// effectScript returns the AppleScript that sends a text message with an effect.
+// AppleScript cannot send effects, so this drives the Messages.app user interface:
+// it opens the conversation, pastes the text, picks the effect and presses return, then
+// restores the clipboard.
+// This needs Accessibility access, and only works for one-on-one chats.
+func (msg *Outgoing) effectScript(chatGUID string) ([]string, error) {
+	name, err := effectName(msg.Effect)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.File || len(msg.Files) > 0 || msg.IsGroup {
+		return nil, fmt.Errorf("%w: effects only work with text in one-on-one chats", ErrUnsupportedChat)
+	}
+
+	openChat, err := openChatScript(chatGUID)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(openChat, `delay 1`, // wait for the conversation window to open.
+		`tell application "System Events" to tell process "Messages"
+	`+pasteScript(msg.body())+`
+	delay 0.5
+	click (first button of group 1 of window 1 whose description is "Apps")
+	delay 0.5
+	click menu item "Message Effects" of menu 1 of group 1 of window 1
+	delay 1
+	click button "`+name+`" of window 1
+	delay 0.5
+	key code 36
+	delay 0.5
+	set the clipboard to savedClipboard
+end tell`), nil
+}
+
+// pasteScript returns the System Events commands that paste text into the focused window.
+// The clipboard is saved in savedClipboard first; put it back after the text is sent.
+func pasteScript(text string) string {
+	return `try
+		set savedClipboard to the clipboard
+	on error -- the clipboard is empty.
+		set savedClipboard to ""
+	end try
+	set the clipboard to "` + escapeAppleScript(text) + `"
+	keystroke "v" using command down`
+}
@@ -0,0 +1,113 @@
+package imessage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorKind is the category of an Error sent to the Errors() channel.
+type ErrorKind string
+
+// These are the kinds of errors sent to the Errors() channel.
+const (
+	ErrorDatabase   ErrorKind = "database"   // opening, querying or closing chat.db.
+	ErrorWatcher    ErrorKind = "watcher"    // the fsnotify file watcher.
+	ErrorSend       ErrorKind = "send"       // sending a message, or running other AppleScripts.
+	ErrorWebhook    ErrorKind = "webhook"    // posting a message with ForwardToWebhook.
+	ErrorAttachment ErrorKind = "attachment" // copying attachments to AttachmentDir.
+	ErrorHandler    ErrorKind = "handler"    // an IncomingCallE callback failed every attempt.
+)
+
+// ErrWatcherClosed is sent to the Errors() channel when the fsnotify watcher fails.
+var ErrWatcherClosed = fmt.Errorf("fsnotify watcher closed")
+
+// Error is an error from one of the background routines. These are sent to the Errors() channel.
+type Error struct {
+	Kind ErrorKind // Kind is the category of error.
+	Msg  string    // Msg describes what was happening when the error occurred.
+	Err  error     // Err is the underlying error.
+}
+
+// Error satisfies the error interface.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Kind, e.Msg, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// SendErrorKind is the category of a SendError.
+type SendErrorKind string
+
+// These are the kinds of SendError.
+const (
+	SendScript     SendErrorKind = "script"     // the AppleScript failed for another reason.
+	SendTimeout    SendErrorKind = "timeout"    // the AppleScript ran longer than Timeout.
+	SendRecipient  SendErrorKind = "recipient"  // Messages.app could not find the buddy or chat.
+	SendPermission SendErrorKind = "permission" // the app may not control Messages.app (Automation access).
+)
+
+// SendError is a failed attempt to run an AppleScript. Every error from a failed send
+// attempt, in Response.Errs and from RunAppleScript, is a *SendError. Use errors.As to
+// get one from the error SendWait returns, or from Response.Err().
+type SendError struct {
+	Kind   SendErrorKind // Kind is the category of failure.
+	Output string        // Output is everything the script printed.
+	Err    error         // Err is the underlying error.
+}
+
+// Error satisfies the error interface.
+func (e *SendError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes a SendError match ErrNotSent with errors.Is.
+func (e *SendError) Is(target error) bool {
+	return target == ErrNotSent //nolint:errorlint,goerr113
+}
+
+// newSendError categorizes a failed script run by its context and output.
+func newSendError(ctx context.Context, output string, err error) *SendError {
+	kind := SendScript
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		kind = SendTimeout
+	case strings.Contains(output, "(-1743)"), strings.Contains(output, "Not authorized to send Apple events"):
+		kind = SendPermission
+	case strings.Contains(output, "(-1728)"), strings.Contains(output, "(-1719)"):
+		kind = SendRecipient // Can't get buddy, participant or chat.
+	}
+
+	return &SendError{Kind: kind, Output: output, Err: err}
+}
+
+// Errors returns a channel that receives errors from the background routines as *Error values.
+// Consuming this channel is optional; errors are still written to ErrorLog. If the channel
+// fills up (it is the size of QueueSize), new errors are dropped until there is room.
+func (m *Messages) Errors() <-chan error {
+	return m.errChan
+}
+
+// checkErr writes an error to Logger if it exists, and sends it to the Errors() channel.
+func (m *Messages) checkErr(err error, kind ErrorKind, msg string) {
+	if err == nil {
+		return
+	}
+
+	m.ErrorLog.Printf("%s: %q\n", msg, err)
+
+	select {
+	case m.errChan <- &Error{Kind: kind, Msg: msg, Err: err}:
+	default:
+	}
+}
@@ -0,0 +1,66 @@
+package imessage
+
+import (
+	"strings"
+	"unicode"
+)
+
+// DefaultCountryCode is the default for Config.CountryCode.
+const DefaultCountryCode = "1"
+
+// Phone numbers shorter than this are short codes, and are not normalized.
+// Phone numbers this long have no country code.
+const (
+	minPhoneDigits   = 7
+	localPhoneDigits = 10
+)
+
+// NormalizeHandle converts an international phone number into E.164 format, like +15551234567.
+// Email addresses are lower cased. Anything else (like short codes, local numbers and
+// numbers with a trunk 0) is returned trimmed, because the country can not be known.
+// A phone number is international if it starts with a +, or with countryCode followed by
+// 10 digits. countryCode is added to 10 digit phone numbers that do not start with a 0.
+func NormalizeHandle(handle, countryCode string) string {
+	handle = strings.TrimSpace(handle)
+
+	if strings.Contains(handle, "@") {
+		return strings.ToLower(handle)
+	}
+
+	var digits strings.Builder
+
+	for _, char := range handle {
+		switch {
+		case unicode.IsDigit(char):
+			digits.WriteRune(char)
+		case unicode.IsLetter(char):
+			return handle // not a phone number.
+		}
+	}
+
+	number := digits.String()
+
+	switch {
+	case len(number) < minPhoneDigits:
+		return handle
+	case strings.HasPrefix(handle, "+"):
+		return "+" + number
+	case countryCode == "":
+		return handle
+	case len(number) == localPhoneDigits && number[0] != '0':
+		return "+" + countryCode + number
+	case len(number) == len(countryCode)+localPhoneDigits && strings.HasPrefix(number, countryCode):
+		return "+" + number
+	default:
+		return handle
+	}
+}
+
+// normalizeHandle normalizes a handle if NormalizeHandles is enabled.
+func (m *Messages) normalizeHandle(handle string) string {
+	if !m.NormalizeHandles {
+		return handle
+	}
+
+	return NormalizeHandle(handle, m.CountryCode)
+}
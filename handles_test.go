@@ -0,0 +1,37 @@
+package imessage
+
+import "testing"
+
+func TestNormalizeHandle(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		handle  string
+		country string
+		expect  string
+	}{
+		{handle: "+1 (555) 123-4567", country: "1", expect: "+15551234567"},
+		{handle: "(555) 123-4567", country: "1", expect: "+15551234567"},
+		{handle: "1-555-123-4567", country: "1", expect: "+15551234567"},
+		{handle: "555-123-4567", country: "44", expect: "+445551234567"},
+		{handle: "+44 20 7946 0958", country: "1", expect: "+442079460958"},
+		{handle: "44 1234 567890", country: "44", expect: "+441234567890"},
+		{handle: " Bob@Example.com ", country: "1", expect: "bob@example.com"},
+		// Not international; the country is not known, so these are not changed.
+		{handle: "555-1234", country: "1", expect: "555-1234"},
+		{handle: "5551234567", country: "", expect: "5551234567"},
+		{handle: "020 7946 0958", country: "44", expect: "020 7946 0958"},
+		{handle: "07946 095812", country: "44", expect: "07946 095812"},
+		{handle: "2-555-123-4567", country: "1", expect: "2-555-123-4567"},
+		{handle: "123456789012", country: "1", expect: "123456789012"},
+		{handle: " 12345 ", country: "1", expect: "12345"},
+		{handle: "+12345", country: "1", expect: "+12345"},
+		{handle: "chat123456789", country: "1", expect: "chat123456789"},
+	}
+
+	for _, test := range tests {
+		if got := NormalizeHandle(test.handle, test.country); got != test.expect {
+			t.Errorf("NormalizeHandle(%q, %q) = %q, expected %q", test.handle, test.country, got, test.expect)
+		}
+	}
+}
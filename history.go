@@ -0,0 +1,93 @@
+package imessage
+
+import (
+	"math"
+
+	"crawshaw.io/sqlite"
+)
+
+// History returns up to `limit` of the most recent messages in a chat, oldest first.
+// Messages sent by this account are included and have FromMe set to true.
+// Use this to give a bot some conversational context when it starts.
+func (m *Messages) History(chatGUID string, limit int) ([]Incoming, error) {
+	return m.HistoryBefore(chatGUID, math.MaxInt64, limit)
+}
+
+// HistoryBefore returns up to `limit` messages in a chat with a RowID less than `before`,
+// oldest first. Pass the RowID of the first message from a previous call to get the page
+// of messages before it.
+//
+//nolint:wrapcheck
+func (m *Messages) HistoryBefore(chatGUID string, before int64, limit int) ([]Incoming, error) {
+	dbase, err := m.getDB()
+	if err != nil {
+		return nil, err
+	}
+
+	defer m.closeDB(dbase)
+
+	sql := messageSQL(`chat.guid = $guid AND message.rowid < $before`, `message.rowid DESC LIMIT $limit`)
+
+	query, sql, err := m.prepareMessages(dbase, sql, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Incoming
+
+	err = m.stepRows(query, func(query *sqlite.Stmt) {
+		list = list[:0]
+		query.SetText("$guid", chatGUID)
+		query.SetInt64("$before", before)
+		query.SetInt64("$limit", int64(limit))
+	}, func(query *sqlite.Stmt) {
+		list = append(list, m.scanMessage(dbase, query))
+	})
+	if err != nil {
+		m.checkErr(err, ErrorDatabase, sql)
+		return nil, err
+	}
+
+	// Newest first came out of the database; reverse it.
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+
+	return list, nil
+}
+
+// LatestPerChat returns the newest message in every chat, newest chat first. Use this for
+// an inbox view of all conversations. Messages sent by this account are included and have
+// FromMe set to true. Every message has a ChatGUID.
+//
+//nolint:wrapcheck
+func (m *Messages) LatestPerChat() ([]Incoming, error) {
+	dbase, err := m.getDB()
+	if err != nil {
+		return nil, err
+	}
+
+	defer m.closeDB(dbase)
+
+	sql := messageSQL(`message.rowid IN `+
+		`(SELECT MAX(message_id) FROM chat_message_join GROUP BY chat_id)`, `message.rowid DESC`)
+
+	query, sql, err := m.prepareMessages(dbase, sql, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Incoming
+
+	err = m.stepRows(query, func(query *sqlite.Stmt) {
+		list = list[:0]
+	}, func(query *sqlite.Stmt) {
+		list = append(list, m.scanMessage(dbase, query))
+	})
+	if err != nil {
+		m.checkErr(err, ErrorDatabase, sql)
+		return nil, err
+	}
+
+	return list, nil
+}
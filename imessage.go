@@ -12,10 +12,17 @@
 package imessage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"crawshaw.io/sqlite"
 )
@@ -25,16 +32,146 @@ import (
 //
 //nolint:lll
 type Config struct {
-	// ClearMsgs will cause this library to clear all iMessage conversations.
+	// ClearMsgs will cause this library to clear all iMessage conversations every ClearInterval,
+	// after messages are sent. This deletes them for good. Set ClearChats to only clear those.
 	ClearMsgs bool `xml:"clear_messages" json:"clear_messages,omitempty" toml:"clear_messages,omitempty" yaml:"clear_messages"`
+	// ClearInterval is how often ClearMsgs clears conversations. Default is DefaultClearInterval (2 minutes).
+	ClearInterval time.Duration `xml:"clear_interval" json:"clear_interval,omitempty" toml:"clear_interval,omitempty" yaml:"clear_interval"`
+	// ClearChats are the chat GUIDs ClearMsgs clears. Other conversations are kept.
+	ClearChats []string `xml:"clear_chats" json:"clear_chats,omitempty" toml:"clear_chats,omitempty" yaml:"clear_chats"`
 	// This is the channel buffer size.
 	QueueSize int `xml:"queue_size" json:"queue_size,omitempty" toml:"queue_size,omitempty" yaml:"queue_size"`
+	// MaxQueueDepth is the most outgoing messages that may wait to be sent. When the queue is full,
+	// Send() and SendWait() fail with ErrQueueFull instead of waiting for room, so callers do not
+	// pile up if osascript stalls. SendBulk() fails if its messages do not all fit.
+	// 0 (default) waits for room; Send() waits when QueueSize messages are in the channel.
+	MaxQueueDepth int `xml:"max_queue_depth" json:"max_queue_depth,omitempty" toml:"max_queue_depth,omitempty" yaml:"max_queue_depth"`
+	// IncomingBuffer is how many new messages may be read from the database before
+	// they are passed to the bindings. The watcher waits when it is full. Default is QueueSize.
+	IncomingBuffer int `xml:"incoming_buffer" json:"incoming_buffer,omitempty" toml:"incoming_buffer,omitempty" yaml:"incoming_buffer"`
 	// How many applescript retries to perform.
 	Retries int `xml:"retries" json:"retries,omitempty" toml:"retries,omitempty" yaml:"retries"`
-	// Timeout in seconds for AppleScript Exec commands.
+	// Timeout in seconds for each AppleScript attempt. A script that runs longer is killed,
+	// and the attempt fails with a SendTimeout error. It may be retried. Minimum is 10.
 	Timeout int `xml:"timeout" json:"timeout,omitempty" toml:"timeout,omitempty" yaml:"timeout"`
+	// RetryDelay is how long to wait before retrying a failed AppleScript. Default is 1 second.
+	RetryDelay time.Duration `xml:"retry_delay" json:"retry_delay,omitempty" toml:"retry_delay,omitempty" yaml:"retry_delay"`
+	// How many times to retry opening or reading the database when it is busy (locked).
+	// Retries back off exponentially, starting at 50ms. Default is 5.
+	DBRetries int `xml:"db_retries" json:"db_retries,omitempty" toml:"db_retries,omitempty" yaml:"db_retries"`
+	// BatchSize is the most outgoing messages to send with a single osascript run.
+	// Queued messages are collected until this many arrive or BatchWait passes.
+	// Batching is disabled if this is less than 2.
+	BatchSize int `xml:"batch_size" json:"batch_size,omitempty" toml:"batch_size,omitempty" yaml:"batch_size"`
+	// SendWorkers is how many recipients may be sent messages at the same time. Messages to the
+	// same recipient (Outgoing.ChatGUID or To) are always sent one at a time, in the order they
+	// were queued (highest Priority first). Messages with ShowTyping, Effect, ReplyTo or a ReactTo
+	// tapback use the Messages.app window, so they are always sent alone.
+	// Default is 1. Ignored when batching (BatchSize > 1).
+	SendWorkers int `xml:"send_workers" json:"send_workers,omitempty" toml:"send_workers,omitempty" yaml:"send_workers"`
+	// BatchWait is how long to wait for more messages to fill a batch. Default is 1 second.
+	BatchWait time.Duration `xml:"batch_wait" json:"batch_wait,omitempty" toml:"batch_wait,omitempty" yaml:"batch_wait"`
+	// SendDelay is how long to wait after running each send AppleScript. Messages can go out
+	// so quickly that Messages.app sends duplicates, or drops some, if this is too low.
+	// Default is DefaultSendDelay (100ms).
+	SendDelay time.Duration `xml:"send_delay" json:"send_delay,omitempty" toml:"send_delay,omitempty" yaml:"send_delay"`
+	// SendJitter adds a random delay of up to this long to SendDelay after each outgoing
+	// message, so sends to real people are not perfectly regular. Default is 0 (no jitter).
+	SendJitter time.Duration `xml:"send_jitter" json:"send_jitter,omitempty" toml:"send_jitter,omitempty" yaml:"send_jitter"`
+	// StatusTimeout is how long to watch for delivery and read status changes after
+	// sending a message with a Status callback. Default is DefaultStatusTimeout (5 minutes).
+	StatusTimeout time.Duration `xml:"status_timeout" json:"status_timeout,omitempty" toml:"status_timeout,omitempty" yaml:"status_timeout"`
+	// VerifySends checks the database after each message is sent, and sets Response.Confirmed
+	// if Messages.app wrote it as an outgoing message. osascript can succeed when Messages.app
+	// quietly fails to send, like when it is not signed in. Reactions and batches are not checked.
+	VerifySends bool `xml:"verify_sends" json:"verify_sends,omitempty" toml:"verify_sends,omitempty" yaml:"verify_sends"`
+	// DryRun logs AppleScript commands to the DebugLog instead of running them. Every
+	// script is treated as successful. Useful for testing the send pipeline without macOS.
+	DryRun bool `xml:"dry_run" json:"dry_run,omitempty" toml:"dry_run,omitempty" yaml:"dry_run"`
+	// NormalizeHandles converts phone numbers to E.164 format (+15551234567) on incoming
+	// messages (Incoming.From), outgoing messages (Outgoing.To), and bindings from WithFrom().
+	// Local numbers, like 555-1234, are left as they are. See NormalizeHandle.
+	NormalizeHandles bool `xml:"normalize_handles" json:"normalize_handles,omitempty" toml:"normalize_handles,omitempty" yaml:"normalize_handles"`
+	// CountryCode is added to 10 digit phone numbers when normalizing handles. Default is 1.
+	CountryCode string `xml:"country_code" json:"country_code,omitempty" toml:"country_code,omitempty" yaml:"country_code"`
+	// IgnoreHandles are this account's own handles and aliases. Incoming messages from these
+	// are dropped, so a bot does not reply to itself. Handles are compared after normalizing.
+	IgnoreHandles []string `xml:"ignore_handles" json:"ignore_handles,omitempty" toml:"ignore_handles,omitempty" yaml:"ignore_handles"`
+	// AttachmentDir is a directory to copy incoming attachments into as soon as they arrive,
+	// before the bindings run. macOS may delete the originals. Attachment.Saved has the copy's path.
+	AttachmentDir string `xml:"attachment_dir" json:"attachment_dir,omitempty" toml:"attachment_dir,omitempty" yaml:"attachment_dir"`
+	// SelfTestHandle is the handle SelfTest() sends a message to. Use one of this account's
+	// own handles. Default is the first IgnoreHandles entry.
+	SelfTestHandle string `xml:"self_test_handle" json:"self_test_handle,omitempty" toml:"self_test_handle,omitempty" yaml:"self_test_handle"`
+	// LoopProtection is how many recently sent message texts to remember. Incoming messages
+	// with exactly the same text as one of these are ignored, which stops auto-responders from
+	// replying to each other (or to themselves) forever. 0 disables loop protection.
+	LoopProtection int `xml:"loop_protection" json:"loop_protection,omitempty" toml:"loop_protection,omitempty" yaml:"loop_protection"`
+	// ResolveNames looks up the sender of each incoming message in the macOS Contacts
+	// (AddressBook) database and fills in Incoming.FromName. Contacts are cached for 10 minutes.
+	ResolveNames bool `xml:"resolve_names" json:"resolve_names,omitempty" toml:"resolve_names,omitempty" yaml:"resolve_names"`
+	// AddressBookPath is the AddressBook-v22.abcddb file used by ResolveNames. By default,
+	// every AddressBook database in ~/Library/Application Support/AddressBook is used.
+	AddressBookPath string `xml:"address_book_path" json:"address_book_path,omitempty" toml:"address_book_path,omitempty" yaml:"address_book_path"`
+	// ProcessBacklog delivers every message already in the database(s) when the library
+	// first starts, instead of only messages that arrive after Start().
+	ProcessBacklog bool `xml:"process_backlog" json:"process_backlog,omitempty" toml:"process_backlog,omitempty" yaml:"process_backlog"`
+	// StartFromRowID delivers messages with a row id greater than this when the library first
+	// starts. Overrides ProcessBacklog. 0 only delivers messages that arrive after Start().
+	StartFromRowID int64 `xml:"start_from_row_id" json:"start_from_row_id,omitempty" toml:"start_from_row_id,omitempty" yaml:"start_from_row_id"`
+	// CursorFile is a file the ID of each database's last handled message is saved to. A message
+	// is saved after it was passed to the middleware and bindings, so after a crash, messages that
+	// were read but not handled are delivered again; none are skipped. Callback functions run in
+	// their own go routines, and may not have finished. On the first Start, reading resumes from the saved IDs, so
+	// messages that arrive while the app is not running are delivered when it starts. Missing
+	// databases start after the newest message. Overridden by SetCurrentID.
+	CursorFile string `xml:"cursor_file" json:"cursor_file,omitempty" toml:"cursor_file,omitempty" yaml:"cursor_file"`
+	// IncomingFilter is an SQL expression added (with AND) to the WHERE clause that selects new
+	// incoming messages, like `message.service = $service`. Columns from the message, handle and
+	// chat tables are available. Put values in IncomingParams, and refer to them by name, instead
+	// of writing them into the filter: the filter is SQL, and anything in it runs against the
+	// database. Never build a filter from untrusted input. Filters with statement separators (;)
+	// or comments are rejected by Init.
+	IncomingFilter string `xml:"incoming_filter" json:"incoming_filter,omitempty" toml:"incoming_filter,omitempty" yaml:"incoming_filter"`
+	// IncomingParams are the named parameters used in IncomingFilter, like {"$service": "SMS"}.
+	// Values may be strings, integers, floats, booleans or nil.
+	IncomingParams map[string]interface{} `xml:"-" json:"incoming_params,omitempty" toml:"incoming_params,omitempty" yaml:"incoming_params"`
+	// IncludeFromMe delivers messages sent from this account (on any device) as incoming
+	// messages too. Their FromMe field is true. Use IgnoreHandles or LoopProtection to avoid
+	// replying to them.
+	IncludeFromMe bool `xml:"include_from_me" json:"include_from_me,omitempty" toml:"include_from_me,omitempty" yaml:"include_from_me"`
+	// SkipEmptyText keeps messages with no text (only whitespace) away from IncomingCall and
+	// IncomingChan bindings, and the IncomingDefault callback, so a '.*' binding does not fire
+	// for them. These are attachment-only messages and stickers (see Incoming.Files), and
+	// unsent messages (Incoming.Retracted). Tapbacks have text, like `Loved "hi"`, so they
+	// are not skipped. IncomingMatch predicates still get every message; use one to handle
+	// attachments, like func(msg Incoming) bool { return msg.File }. Attachments are still
+	// saved to AttachmentDir.
+	SkipEmptyText bool `xml:"skip_empty_text" json:"skip_empty_text,omitempty" toml:"skip_empty_text,omitempty" yaml:"skip_empty_text"`
+	// Interval is how often the databases are polled if the file watcher fails, and the longest
+	// a burst of database writes may delay checking for new messages. Default is DefaultDuration
+	// (200ms). Use SetInterval() to change it while running.
+	Interval time.Duration `xml:"interval" json:"interval,omitempty" toml:"interval,omitempty" yaml:"interval"`
+	// Debounce is how long to wait after the last database write before checking for new messages.
+	// A burst of writes is checked once, but never waits more than Interval. Default is DefaultDebounce (25ms).
+	Debounce time.Duration `xml:"debounce" json:"debounce,omitempty" toml:"debounce,omitempty" yaml:"debounce"`
 	// SQLPath is the location if the iMessage database.
 	SQLPath string `xml:"sql_path" json:"sql_path,omitempty" toml:"sql_path,omitempty" yaml:"sql_path"`
+	// SQLPaths are more iMessage databases to watch for incoming messages, like those from other
+	// macOS accounts or a backup copy. Each is watched independently, and Incoming.Source says
+	// which database a message came from. Other queries (like History) only use SQLPath.
+	SQLPaths []string `xml:"sql_paths" json:"sql_paths,omitempty" toml:"sql_paths,omitempty" yaml:"sql_paths"`
+	// Source provides incoming messages. Default watches the databases at SQLPath and SQLPaths.
+	Source Source `xml:"-" json:"-" toml:"-" yaml:"-"`
+	// OSAScriptPath is the osascript binary used by the default runners. Default is the
+	// OSAScriptPath package variable, /usr/bin/osascript.
+	OSAScriptPath string `xml:"osascript_path" json:"osascript_path,omitempty" toml:"osascript_path,omitempty" yaml:"osascript_path"`
+	// Runner runs the AppleScripts that send messages. Default runs them with osascript.
+	Runner ScriptRunner `xml:"-" json:"-" toml:"-" yaml:"-"`
+	// JSRunner runs the scripts passed to RunJavaScript(). Default runs them with osascript -l JavaScript.
+	JSRunner ScriptRunner `xml:"-" json:"-" toml:"-" yaml:"-"`
+	// Clock is used for every delay, timeout and timestamp. Default is the system clock.
+	Clock Clock `xml:"-" json:"-" toml:"-" yaml:"-"`
 	// Loggers.
 	ErrorLog Logger `xml:"-" json:"-" toml:"-" yaml:"-"`
 	DebugLog Logger `xml:"-" json:"-" toml:"-" yaml:"-"`
@@ -44,12 +181,28 @@ type Config struct {
 // All of the important library methods are bound to this type.
 // ErrorLog and DebugLog can be set directly, or use the included methods to set them.
 type Messages struct {
-	*Config                 // Input config.
-	running   bool          // Only used in Start() and Stop()
-	currentID int64         // Constantly growing
-	outChan   chan Outgoing // send
-	inChan    chan Incoming // receive
-	binds                   // incoming message handlers
+	*Config                      // Input config.
+	running      bool            // True between Start() and Stop().
+	runLock      sync.Mutex      // Protects running, stopped, ready and outDone; serializes Start and Stop.
+	stopped      chan struct{}   // Closed by Stop(), used by StartWithContext().
+	ready        *readiness      // Set by Start(), used by Ready().
+	sources      []*source       // Databases watched for incoming messages.
+	outChan      chan Outgoing   // send
+	outLock      sync.RWMutex    // Protects outChan, and keeps it from being closed while a message is queued.
+	outShut      bool            // outChan is closed; no more messages are accepted.
+	outDone      chan struct{}   // Closed when the outgoing routine returns.
+	intervalLock sync.Mutex      // Protects Interval, which SetInterval changes while running.
+	intervalSet  chan struct{}   // SetInterval signals the watcher.
+	queue        *outQueue       // outgoing messages waiting to be sent.
+	incoming     Source          // Config.Source, or the default.
+	errChan      chan error      // Errors()
+	stats        *counters       // Stats()
+	contacts     contacts        // cached AddressBook names.
+	ignored      map[string]bool // normalized IgnoreHandles.
+	recent       *recentSent     // recently sent texts, for LoopProtection.
+	cursor       cursor          // saved to CursorFile.
+	selfTest     selfTest        // the message SelfTest() is waiting to receive.
+	binds                        // incoming message handlers
 }
 
 // Logger is a base interface to deal with changing log outs.
@@ -63,42 +216,138 @@ type Logger interface {
 
 var ErrAlreadyRunning = fmt.Errorf("already running")
 
+// ErrNoDiskAccess is returned when the iMessage database can not be read because of permissions.
+// On macOS, ~/Library/Messages is protected: the app reading it (or the Terminal or service
+// that runs it) must be given Full Disk Access in System Settings -> Privacy & Security.
+var ErrNoDiskAccess = fmt.Errorf("permission denied reading the iMessage database; " +
+	"grant Full Disk Access to this app (or the terminal running it) in System Settings -> Privacy & Security")
+
+// ErrNotStarted is returned by Ready() if Start() was never called.
+var ErrNotStarted = fmt.Errorf("not started")
+
+// maxRetries is the most AppleScript attempts allowed for one message.
+const maxRetries = 10
+
+// dbBackoff is the first delay when retrying a busy database. It doubles each retry.
+const dbBackoff = 50 * time.Millisecond
+
 // Init is the primary function to retrieve a Message handler.
 // Pass a Config struct in and use the returned Messages struct to send
 // and respond to incoming messages.
 func Init(config *Config) (*Messages, error) {
-	if _, err := os.Stat(config.SQLPath); err != nil {
-		return nil, fmt.Errorf("sql file access error: %w", err)
+	sources := newSources(config)
+	for _, src := range sources {
+		if _, err := os.Stat(src.path); err != nil && config.Source == nil {
+			return nil, fmt.Errorf("sql file access error: %w", diskAccessErr(src.path, err))
+		}
+	}
+
+	if err := config.checkFilter(); err != nil {
+		return nil, err
 	}
 
 	config.setDefaults()
 
 	msg := &Messages{
-		Config:  config,
-		outChan: make(chan Outgoing, config.QueueSize),
-		inChan:  make(chan Incoming, config.QueueSize),
+		Config:      config,
+		sources:     sources,
+		outChan:     make(chan Outgoing, config.QueueSize),
+		queue:       newOutQueue(),
+		intervalSet: make(chan struct{}, 1),
+		errChan:     make(chan error, config.QueueSize),
+		stats:       &counters{},
+		ignored:     make(map[string]bool),
+		recent:      newRecentSent(config.LoopProtection),
+	}
+
+	for _, handle := range config.IgnoreHandles {
+		msg.ignored[NormalizeHandle(handle, config.CountryCode)] = true
 	}
 
-	// Try to open, query and close the database.
-	return msg, msg.getCurrentID()
+	if msg.incoming = config.Source; msg.incoming != nil {
+		return msg, nil
+	}
+
+	msg.incoming = &chatDB{m: msg}
+
+	// Try to open, query and close the database(s).
+	return msg, msg.getCurrentIDs()
 }
 
 //nolint:gomnd,nolintlint
 func (c *Config) setDefaults() {
 	if c.Retries == 0 {
 		c.Retries = 3
-	} else if c.Retries > 10 {
-		c.Retries = 10
+	} else if c.Retries > maxRetries {
+		c.Retries = maxRetries
+	}
+
+	if c.RetryDelay <= 0 {
+		c.RetryDelay = time.Second
+	}
+
+	if c.DBRetries == 0 {
+		c.DBRetries = 5
+	}
+
+	if c.CountryCode == "" {
+		c.CountryCode = DefaultCountryCode
+	}
+
+	c.CountryCode = strings.TrimPrefix(c.CountryCode, "+")
+
+	if c.SendDelay <= 0 {
+		c.SendDelay = DefaultSendDelay
+	}
+
+	if c.StatusTimeout <= 0 {
+		c.StatusTimeout = DefaultStatusTimeout
+	}
+
+	if c.BatchSize > 1 && c.BatchWait <= 0 {
+		c.BatchWait = time.Second
 	}
 
 	if c.QueueSize < 10 {
 		c.QueueSize = 10
 	}
 
+	if c.ClearInterval <= 0 {
+		c.ClearInterval = DefaultClearInterval
+	}
+
+	if c.Interval <= 0 {
+		c.Interval = DefaultDuration
+	}
+
+	if c.Debounce <= 0 {
+		c.Debounce = DefaultDebounce
+	}
+
+	if c.SendWorkers < 1 {
+		c.SendWorkers = 1
+	}
+
+	if c.IncomingBuffer <= 0 {
+		c.IncomingBuffer = c.QueueSize
+	}
+
 	if c.Timeout < 10 {
 		c.Timeout = 10
 	}
 
+	if c.Clock == nil {
+		c.Clock = systemClock{}
+	}
+
+	if c.Runner == nil {
+		c.Runner = osascript{path: c.OSAScriptPath}
+	}
+
+	if c.JSRunner == nil {
+		c.JSRunner = osascript{path: c.OSAScriptPath, language: "JavaScript"}
+	}
+
 	if c.ErrorLog == nil {
 		c.ErrorLog = log.New(io.Discard, "[ERROR] ", log.LstdFlags)
 	}
@@ -111,60 +360,296 @@ func (c *Config) setDefaults() {
 // Start starts the iMessage-sqlite3 db and outgoing message watcher routine(s).
 // Outgoing messages wont work and incoming message are ignored until Start() runs.
 func (m *Messages) Start() error {
+	m.runLock.Lock()
+	defer m.runLock.Unlock()
+
+	return m.start()
+}
+
+// start starts the message routines. Call with runLock held.
+func (m *Messages) start() error {
 	if m.running {
 		return ErrAlreadyRunning
-	} else if err := m.getCurrentID(); err != nil {
+	}
+
+	m.ready = &readiness{done: make(chan struct{})}
+	if err := m.incoming.Start(); err != nil {
+		m.setReady(m.ready, err)
 		return err
 	}
 
+	if _, ok := m.incoming.(*chatDB); !ok {
+		m.setReady(m.ready, nil) // Custom sources are ready when they start.
+	}
+
 	m.running = true
-	m.DebugLog.Printf("starting with id %d", m.currentID)
+	m.stopped = make(chan struct{})
+	prevDone := m.outDone
+	m.outDone = make(chan struct{})
 
-	go m.processOutgoingMessages()
+	m.outLock.Lock()
+	if m.outShut { // Stopped before; accept messages again.
+		m.outChan = make(chan Outgoing, m.QueueSize)
+		m.outShut = false
+	}
 
-	return m.processIncomingMessages()
+	outChan := m.outChan
+	m.outLock.Unlock()
+
+	go func(prev, done chan struct{}) {
+		if prev != nil {
+			<-prev // The last routine may still be sending what was queued before Stop.
+		}
+
+		m.processOutgoingMessages(outChan)
+		close(done)
+	}(prevDone, m.outDone)
+	go m.processIncomingMessages(m.incoming.Messages())
+
+	return nil
+}
+
+// StartWithContext is the same as Start, except the message routines are also stopped
+// when the provided context is cancelled. Calling Stop() still works as usual.
+func (m *Messages) StartWithContext(ctx context.Context) error {
+	m.runLock.Lock()
+	defer m.runLock.Unlock()
+
+	if err := m.start(); err != nil {
+		return err
+	}
+
+	go func(stopped chan struct{}) {
+		select {
+		case <-ctx.Done():
+			m.DebugLog.Printf("context ended, stopping: %v", ctx.Err())
+			m.runLock.Lock()
+			defer m.runLock.Unlock()
+
+			if m.stopped == stopped { // Not stopped (and started again) already.
+				m.stop()
+			}
+		case <-stopped:
+		}
+	}(m.stopped)
+
+	return nil
 }
 
 // Stop cancels the iMessage-sqlite3 db and outgoing message watcher routine(s).
 // Outgoing messages stop working when the routines are stopped.
 // Incoming messages are ignored after this runs.
 func (m *Messages) Stop() {
-	defer func() { m.running = false }()
+	m.runLock.Lock()
+	defer m.runLock.Unlock()
 
+	m.stop()
+}
+
+// stop stops the message routines, if they are running. Call with runLock held.
+func (m *Messages) stop() {
 	if m.running {
-		close(m.inChan)
+		m.running = false
+		close(m.stopped)
+		m.incoming.Stop()
+		m.closeOutgoing()
+	}
+}
+
+// isRunning returns true between Start() and Stop().
+func (m *Messages) isRunning() bool {
+	m.runLock.Lock()
+	defer m.runLock.Unlock()
+
+	return m.running
+}
+
+// Ready blocks until the incoming message watcher is running: every database was opened,
+// the starting message IDs were found, and any backlog (or messages since the saved cursor)
+// was read. Returns the error that stopped Start(), if any. Use this to fail fast when the
+// database can not be read, like when the app does not have Full Disk Access.
+func (m *Messages) Ready() error {
+	m.runLock.Lock()
+	ready := m.ready
+	m.runLock.Unlock()
+
+	if ready == nil {
+		return ErrNotStarted
+	}
+
+	<-ready.done
+
+	return ready.err
+}
+
+// readiness is the result of starting the incoming source, for one Start().
+type readiness struct {
+	done chan struct{} // Closed when the source is ready, or failed.
+	err  error         // Why the source failed to start.
+}
+
+// setReady marks the incoming source ready, or failed. ready is the one made by the
+// same Start(), so a late source can not change a newer one.
+func (m *Messages) setReady(ready *readiness, err error) {
+	ready.err = err
+	close(ready.done)
+}
+
+// Shutdown stops accepting new outgoing messages, waits for the queued messages to
+// be sent, then stops like Stop(). If the context ends first, Shutdown stops without
+// waiting and returns the context's error; the queued messages are still sent in the
+// background. Use this in short-lived programs that send a message and exit.
+func (m *Messages) Shutdown(ctx context.Context) error {
+	m.runLock.Lock()
+	running, outDone := m.running, m.outDone
+	m.runLock.Unlock()
+
+	if !running {
+		return nil
+	}
+
+	m.closeOutgoing()
+
+	var err error
+
+	select {
+	case <-outDone:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	m.Stop()
+
+	return err
+}
+
+// closeOutgoing closes the outgoing message channel. Messages sent after this fail with ErrStopped.
+func (m *Messages) closeOutgoing() {
+	m.outLock.Lock()
+	defer m.outLock.Unlock()
+
+	if !m.outShut {
+		m.outShut = true
 		close(m.outChan)
 	}
 }
 
-// getDB opens a database connection and locks access, so only one reader can
-// access the db at once.
+// getDB opens a connection to the primary database (SQLPath). See getDBPath.
 func (m *Messages) getDB() (*sqlite.Conn, error) {
-	m.Lock()
-	m.DebugLog.Println("opening database:", m.SQLPath)
+	return m.getDBPath(m.SQLPath)
+}
 
-	db, err := sqlite.OpenConn(m.SQLPath, sqlite.SQLITE_OPEN_READONLY)
-	m.checkErr(err, "opening database")
+// getDBPath opens a read-only database connection. Each caller gets its own connection,
+// so a watcher check can not close the connection out from under History() or another
+// query, and queries run at the same time. Opening is retried with backoff while the
+// database is busy. Call closeDB() when done with the connection.
+func (m *Messages) getDBPath(path string) (*sqlite.Conn, error) {
+	m.DebugLog.Println("opening database:", path)
+
+	db, err := openDB(path)
+	for i := 0; isBusy(err) && i < m.DBRetries; i++ {
+		m.DebugLog.Printf("database busy, retrying in %v: %v", dbBackoff<<i, err)
+		m.Clock.Sleep(dbBackoff << i)
+		db, err = openDB(path)
+	}
+
+	if err != nil {
+		err = diskAccessErr(path, err)
+		m.checkErr(err, ErrorDatabase, "opening database")
+	}
 
 	return db, err //nolint:wrapcheck
 }
 
-// closeDB stops reading the sqlite db and unlocks the read lock.
-func (m *Messages) closeDB(dbase io.Closer) {
-	m.DebugLog.Println("closing database:", m.SQLPath)
+// diskAccessErr wraps err with ErrNoDiskAccess if the file at path can not be read because
+// of permissions. Without Full Disk Access, macOS denies opening files in ~/Library/Messages,
+// and sqlite only says it is "unable to open database file".
+func diskAccessErr(path string, err error) error {
+	if err == nil || errors.Is(err, ErrNoDiskAccess) {
+		return err
+	}
 
-	if dbase == nil {
-		m.DebugLog.Print("db was nil? not closed")
-		return
+	code := sqlite.ErrCode(err) & 0xff //nolint:gomnd // primary result code.
+	denied := errors.Is(err, os.ErrPermission) || code == sqlite.SQLITE_AUTH || code == sqlite.SQLITE_PERM
+
+	if !denied && code == sqlite.SQLITE_CANTOPEN {
+		// sqlite does not say why it could not open the file, so find out.
+		file, openErr := os.Open(path)
+		if denied = errors.Is(openErr, os.ErrPermission); openErr == nil {
+			_ = file.Close()
+		}
+	}
+
+	if !denied {
+		return err
 	}
 
-	defer m.Unlock()
-	m.checkErr(dbase.Close(), "closing database: "+m.SQLPath)
+	return fmt.Errorf("%w: %s: %v", ErrNoDiskAccess, path, err) //nolint:errorlint
 }
 
-// checkErr writes an error to Logger if it exists.
-func (m *Messages) checkErr(err error, msg string) {
+// openDB opens the database read-only using a mode=ro URI. Messages.app keeps chat.db
+// in WAL journal mode. The journal mode is stored in the database file, so this read-only
+// connection reads the WAL (and sees recently committed messages) without trying to
+// change the journal mode, which would require write access and contend with Messages.app.
+func openDB(path string) (*sqlite.Conn, error) {
+	path, err := filepath.Abs(path)
 	if err != nil {
-		m.ErrorLog.Printf("%s: %q\n", msg, err)
+		return nil, fmt.Errorf("database path: %w", err)
 	}
+
+	uri := &url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro"}
+
+	//nolint:wrapcheck
+	return sqlite.OpenConn(uri.String(),
+		sqlite.SQLITE_OPEN_READONLY|sqlite.SQLITE_OPEN_URI|sqlite.SQLITE_OPEN_NOMUTEX)
+}
+
+// stepRows steps through every row of a query and calls row for each result. bind is called
+// to set the query parameters first. If the database is busy, the query is reset and bind
+// is called again before retrying, with backoff. The query is always finalized.
+func (m *Messages) stepRows(query *sqlite.Stmt, bind, row func(*sqlite.Stmt)) error {
+	defer func() { _ = query.Finalize() }()
+
+	bind(query)
+
+	for retries := 0; ; {
+		hasRow, err := query.Step()
+
+		switch {
+		case isBusy(err) && retries < m.DBRetries:
+			m.DebugLog.Printf("database busy, retrying in %v: %v", dbBackoff<<retries, err)
+			m.Clock.Sleep(dbBackoff << retries)
+			retries++
+
+			if err := query.Reset(); err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			bind(query)
+		case err != nil:
+			return err //nolint:wrapcheck
+		case !hasRow:
+			return nil
+		default:
+			row(query)
+		}
+	}
+}
+
+// isBusy returns true if the error is from a busy or locked sqlite database.
+func isBusy(err error) bool {
+	code := sqlite.ErrCode(err) & 0xff //nolint:gomnd // primary result code.
+	return code == sqlite.SQLITE_BUSY || code == sqlite.SQLITE_LOCKED
+}
+
+// closeDB stops reading the sqlite db.
+func (m *Messages) closeDB(dbase io.Closer) {
+	m.DebugLog.Println("closing database")
+
+	if dbase == nil {
+		m.DebugLog.Print("db was nil? not closed")
+		return
+	}
+
+	m.checkErr(dbase.Close(), ErrorDatabase, "closing database")
 }
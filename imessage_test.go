@@ -0,0 +1,153 @@
+package imessage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// testTables are the tables, besides message, that this library reads from chat.db.
+const testTables = `
+CREATE TABLE handle (ROWID INTEGER PRIMARY KEY AUTOINCREMENT UNIQUE, id TEXT NOT NULL, service TEXT NOT NULL);
+CREATE TABLE chat (ROWID INTEGER PRIMARY KEY AUTOINCREMENT, guid TEXT UNIQUE NOT NULL, style INTEGER,
+	chat_identifier TEXT, service_name TEXT, display_name TEXT);
+CREATE TABLE chat_message_join (chat_id INTEGER, message_id INTEGER, message_date INTEGER DEFAULT 0,
+	PRIMARY KEY (chat_id, message_id));
+CREATE TABLE chat_handle_join (chat_id INTEGER, handle_id INTEGER, UNIQUE(chat_id, handle_id));
+CREATE TABLE attachment (ROWID INTEGER PRIMARY KEY AUTOINCREMENT, guid TEXT UNIQUE NOT NULL,
+	filename TEXT, mime_type TEXT, transfer_name TEXT, total_bytes INTEGER DEFAULT 0);
+CREATE TABLE message_attachment_join (message_id INTEGER, attachment_id INTEGER, UNIQUE(message_id, attachment_id));
+INSERT INTO handle (id, service) VALUES ('+15551234567', 'iMessage'), ('bob@example.com', 'iMessage');
+INSERT INTO chat (guid, style, chat_identifier, service_name, display_name)
+	VALUES ('iMessage;-;+15551234567', 45, '+15551234567', 'iMessage', ''),
+	('iMessage;+;chat123', 43, 'chat123', 'iMessage', 'Family');
+INSERT INTO chat_handle_join VALUES (1, 1), (2, 1), (2, 2);
+`
+
+// newTestDB creates a chat.db with the iMessage schema in a temporary directory, with two
+// handles and two chats: a one-on-one chat (1) with handle 1, and a group chat (2).
+func newTestDB(t *testing.T) string {
+	t.Helper()
+
+	// The schema file predates edits and threaded replies.
+	return createTestDB(t, "DEFAULT NULL, thread_originator_guid TEXT, "+
+		"date_edited INTEGER DEFAULT 0, date_retracted INTEGER DEFAULT 0);")
+}
+
+// newOldTestDB creates a test chat.db like newTestDB, with the message table from the schema
+// file as it is: without edits and threaded replies, like before macOS 11.
+func newOldTestDB(t *testing.T) string {
+	t.Helper()
+
+	return createTestDB(t, "DEFAULT NULL );")
+}
+
+// createTestDB creates a test chat.db, with the end of the message table replaced with end.
+func createTestDB(t *testing.T, end string) string {
+	t.Helper()
+
+	schema, err := os.ReadFile("message_schema.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := string(schema[strings.Index(string(schema), "CREATE TABLE message"):])
+	message = strings.Replace(message, "DEFAULT NULL );", end, 1)
+
+	path := filepath.Join(t.TempDir(), "chat.db")
+	execTestDB(t, path, message+testTables)
+
+	return path
+}
+
+// execTestDB runs a sql script against a test database.
+func execTestDB(t *testing.T, path, script string) {
+	t.Helper()
+
+	conn, err := sqlite.OpenConn(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if err := sqlitex.ExecScript(conn, script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addTestMessage adds an incoming text message from a handle, in a chat, at a date, and returns its row id.
+func addTestMessage(t *testing.T, path string, handle, chat int64, text string, date int64) int64 {
+	t.Helper()
+
+	conn, err := sqlite.OpenConn(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	err = sqlitex.Exec(conn, `INSERT INTO message (guid, text, handle_id, date, service) `+
+		`VALUES (lower(hex(randomblob(16))), ?, ?, ?, 'iMessage')`, nil, text, handle, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := conn.LastInsertRowID()
+
+	err = sqlitex.Exec(conn, `INSERT INTO chat_message_join (chat_id, message_id) VALUES (?, ?)`, nil, chat, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+// newTestMessages returns a Messages for a test database that sends with DryRun.
+func newTestMessages(t *testing.T, config *Config) *Messages {
+	t.Helper()
+
+	if config.SQLPath == "" {
+		config.SQLPath = newTestDB(t)
+	}
+
+	config.DryRun = true
+
+	m, err := Init(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+// Cancelling the context, Stop() and Shutdown() may all happen at once.
+func TestStartWithContextStop(t *testing.T) {
+	t.Parallel()
+
+	for i := 0; i < 20; i++ {
+		m := newTestMessages(t, &Config{})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := m.StartWithContext(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+
+		wg.Add(3)
+
+		go func() { defer wg.Done(); cancel() }()
+		go func() { defer wg.Done(); m.Stop() }()
+		go func() { defer wg.Done(); _ = m.Shutdown(context.Background()) }()
+
+		wg.Wait()
+		m.Stop()
+	}
+}
@@ -2,28 +2,100 @@ package imessage
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"crawshaw.io/sqlite"
 	"github.com/fsnotify/fsnotify"
 )
 
-// DefaultDuration is the minimum interval that must pass before opening the database again.
+// DefaultDuration is the default for Config.Interval.
 const DefaultDuration = 200 * time.Millisecond
 
+// DefaultDebounce is the default for Config.Debounce.
+const DefaultDebounce = 25 * time.Millisecond
+
+// appleEpoch is the zero time for dates stored in the iMessage database.
+// nanoDateMin is the smallest date value assumed to be in nanoseconds; older
+// versions of macOS stored seconds, and no seconds value will ever be this large.
+const (
+	appleEpoch  = 978307200 // 2001-01-01 00:00:00 UTC in unix seconds.
+	nanoDateMin = 1e11
+)
+
 var ErrNoRows = fmt.Errorf("no message rows found")
 
 // Incoming is represents a message from someone. This struct is filled out
 // and sent to incoming callback methods and/or to bound channels.
 type Incoming struct {
-	RowID int64  // RowID is the unique database row id.
-	From  string // From is the handle of the user who sent the message.
-	Text  string // Text is the body of the message.
-	Group string
-	File  bool // File is true if a file is attached. (no way to access it atm)
+	RowID int64  `json:"row_id"` // RowID is the unique database row id.
+	GUID  string `json:"guid"`   // GUID is the unique message identifier. Reactions target this.
+	From  string `json:"from"`   // From is the handle of the user who sent the message.
+	// HandleID is the sender's row id in the handle table. 0 for messages from this account.
+	HandleID int64 `json:"handle_id"`
+	// ChatID is the row id of the message's chat in the chat table. 0 if it has no chat.
+	ChatID int64 `json:"chat_id"`
+	// RawFrom is the sender's handle exactly as it appears in the database.
+	// Same as From, unless NormalizeHandles is enabled.
+	RawFrom string `json:"raw_from"`
+	// FromName is the sender's name from Contacts. Only filled in if ResolveNames is enabled.
+	FromName string `json:"from_name"`
+	// Source is the path of the database this message came from: SQLPath or one of SQLPaths.
+	Source string `json:"source"`
+	Text   string `json:"text"` // Text is the body of the message.
+	// Subject is the message's subject line, if it has one. Used by some SMS and business messages.
+	Subject string    `json:"subject,omitempty"`
+	Date    time.Time `json:"date"` // Date is when the message was sent, according to the database.
+	// Service is the network the message arrived on, iMessage or SMS.
+	// SMS messages only show up if Text Message Forwarding is enabled.
+	Service string `json:"service"`
+	Group   string `json:"group"`
+	// ChatGUID is the unique chat identifier. Present for group chats and one-on-one chats.
+	ChatGUID string `json:"chat_guid"`
+	// ChatName is the display name of a named group chat. Empty for one-on-one chats.
+	ChatName string        `json:"chat_name"`
+	File     bool          `json:"file"`               // File is true if a file is attached. Details are in Files.
+	Files    []*Attachment `json:"files,omitempty"`    // Files contains the attachments on this message, if any.
+	Reaction *Reaction     `json:"reaction,omitempty"` // Reaction is not nil if this message is a tapback on another message.
+	// ReplyToGUID is the GUID of the message this one replied to in a thread (an inline reply).
+	// Empty for messages that are not replies. Pass it to Outgoing.ReplyTo to reply in the same thread.
+	ReplyToGUID string `json:"reply_to_guid,omitempty"`
+	// IsAudio is true for audio (voice) messages recorded in Messages. The recording is in Files.
+	IsAudio bool `json:"is_audio,omitempty"`
+	// Effect is the bubble or screen effect the message was sent with, like "slam" or "confetti".
+	// These match the Outgoing.Effect values. Unknown effects are the raw expressive_send_style_id.
+	Effect string `json:"effect,omitempty"`
+	FromMe bool   `json:"from_me"` // FromMe is true for messages sent by this account. Only found in History().
+	// Edited is true if this is an update to a message that was already delivered, because the
+	// sender edited it. RowID and GUID are the original message's, and Text is the new text.
+	Edited bool `json:"edited,omitempty"`
+	// Retracted is true if this is an update to a message that was already delivered,
+	// because the sender unsent it. RowID and GUID are the original message's.
+	Retracted bool `json:"retracted,omitempty"`
+	// Mentioned is true if this account was @mentioned in the message. Only group chats have mentions.
+	Mentioned bool `json:"mentioned"`
+}
+
+// IsGroup returns true if the message was received in a group chat.
+func (i *Incoming) IsGroup() bool {
+	return strings.Contains(i.ChatGUID, ";+;")
+}
+
+// Reply returns an Outgoing message with text that goes back to the conversation this
+// message came from: the group chat for group messages, or the sender for one-on-one
+// messages. Pass it to Send() or SendWait(), like m.Send(msg.Reply("got it")).
+// The chat GUID is used when it is known, so replies go out on the same service (SMS or iMessage).
+func (i *Incoming) Reply(text string) Outgoing {
+	if i.ChatGUID != "" {
+		return Outgoing{To: i.ChatGUID, Text: text, IsGroup: i.IsGroup()}
+	}
+
+	return Outgoing{To: i.RawFrom, Text: text}
 }
 
 // Callback is the type used to return an incoming message to the consuming app.
@@ -31,42 +103,193 @@ type Incoming struct {
 // using a callback (as opposed to a channel).
 type Callback func(msg Incoming)
 
+// CallbackE is a Callback that can fail. Return an error to have the message delivered again.
+type CallbackE func(msg Incoming) error
+
+// These are the retry defaults for IncomingCallE bindings. Change them with WithRetry().
+const (
+	DefaultHandlerRetries = 3
+	DefaultHandlerBackoff = time.Second
+)
+
 type chanBinding struct {
-	Match string
-	Chan  chan Incoming
+	binding
+	Chan chan Incoming
 }
 
 type funcBinding struct {
-	Match string
-	Func  Callback
+	binding
+	Func Callback
 }
 
 type binds struct {
-	Funcs []*funcBinding
-	Chans []*chanBinding
+	Funcs   []*funcBinding
+	Chans   []*chanBinding
+	Default Callback // runs when nothing else matches.
+	// Middleware runs on every message before the bindings, in order.
+	Middleware []Middleware
 	// locks either or both slices
 	sync.RWMutex
 }
 
+// Middleware changes an incoming message before the bindings see it. Return false to drop it.
+type Middleware func(msg Incoming) (Incoming, bool)
+
+// Use adds middleware that runs on every incoming message before the bindings, in the order
+// it was added. Use it to enrich, rewrite or filter messages, like stripping a command prefix
+// or redacting text. Each middleware gets the message the previous one returned. When one
+// returns false, the message is dropped; no more middleware or bindings run.
+func (m *Messages) Use(middleware ...Middleware) {
+	m.binds.Lock()
+	defer m.binds.Unlock()
+
+	m.Middleware = append(m.Middleware, middleware...)
+}
+
+// runMiddleware passes a message through every Middleware. Returns false if one dropped it.
+func (m *Messages) runMiddleware(msg Incoming) (Incoming, bool) {
+	m.binds.RLock()
+	middleware := m.Middleware
+	m.binds.RUnlock()
+
+	for _, mw := range middleware {
+		var keep bool
+		if msg, keep = mw(msg); !keep {
+			return msg, false
+		}
+	}
+
+	return msg, true
+}
+
 // IncomingChan connects a channel to a matched string in a message.
 // Similar to the IncomingCall method, this will send an incoming message
 // to a channel. Any message with text matching `match` is sent. Regexp supported.
-// Use '.*' for all messages. The channel blocks, so avoid long operations.
-func (m *Messages) IncomingChan(match string, channel chan Incoming) {
+// Use '.*' for all messages. The channel blocks, so avoid long operations,
+// or pass NonBlocking() to drop messages when the channel is full.
+// Pass WithMatchMode() to use something other than a regular expression.
+// Returns an error if the match string does not compile; the channel is not bound.
+func (m *Messages) IncomingChan(match string, channel chan Incoming, opts ...BindOption) error {
+	bind, err := newBinding(match, opts)
+	if err != nil {
+		return err
+	}
+
+	bind.From = m.normalizeHandle(bind.From)
+
 	m.binds.Lock()
 	defer m.binds.Unlock()
 
-	m.Chans = append(m.Chans, &chanBinding{Match: match, Chan: channel})
+	m.Chans = append(m.Chans, &chanBinding{binding: bind, Chan: channel})
+
+	return nil
 }
 
 // IncomingCall connects a callback function to a matched string in a message.
 // This methods creates a callback that is run in a go routine any time
 // a message containing `match` is found. Use '.*' for all messages. Supports regexp.
-func (m *Messages) IncomingCall(match string, callback Callback) {
+// Pass WithMatchMode() to use something other than a regular expression.
+// Returns an error if the match string does not compile; the callback is not bound.
+func (m *Messages) IncomingCall(match string, callback Callback, opts ...BindOption) error {
+	bind, err := newBinding(match, opts)
+	if err != nil {
+		return err
+	}
+
+	m.bindFunc(bind, callback)
+
+	return nil
+}
+
+// IncomingMatch connects a callback function to messages that satisfy a custom predicate.
+// Use this for matching logic that a single string cannot express, like checking the
+// sender against an allow list and the text for a prefix. The callback runs in a go
+// routine. Remove these bindings with RemoveCall(""). Options that change the match
+// string (WithMatchMode) are ignored.
+func (m *Messages) IncomingMatch(pred Predicate, callback Callback, opts ...BindOption) {
+	bind := binding{}
+	bind.apply(opts)
+	bind.pred, bind.custom = pred, true
+
+	m.bindFunc(bind, callback)
+}
+
+// bindFunc adds a callback function binding and returns it.
+func (m *Messages) bindFunc(bind binding, callback Callback) *funcBinding {
+	bind.From = m.normalizeHandle(bind.From)
+	fn := &funcBinding{binding: bind, Func: callback}
+
 	m.binds.Lock()
 	defer m.binds.Unlock()
 
-	m.Funcs = append(m.Funcs, &funcBinding{Match: match, Func: callback})
+	m.Funcs = append(m.Funcs, fn)
+
+	return fn
+}
+
+// IncomingCallE is the same as IncomingCall, except the callback returns an error. When it
+// does, the error is logged, and the message is passed to the callback again after a backoff
+// that doubles each time, up to DefaultHandlerRetries more times. Change that with WithRetry().
+// If every attempt fails, an Error with ErrorHandler kind goes to the Errors() channel.
+// Use this to forward messages to flaky services with at-least-once delivery.
+func (m *Messages) IncomingCallE(match string, callback CallbackE, opts ...BindOption) error {
+	opts = append([]BindOption{WithRetry(DefaultHandlerRetries, DefaultHandlerBackoff)}, opts...)
+
+	bind, err := newBinding(match, opts)
+	if err != nil {
+		return err
+	}
+
+	m.bindFunc(bind, m.retryCallback(bind, callback))
+
+	return nil
+}
+
+// retryCallback turns a CallbackE into a Callback that retries with the binding's retry settings.
+func (m *Messages) retryCallback(bind binding, callback CallbackE) Callback {
+	return func(msg Incoming) {
+		backoff := bind.backoff
+
+		for attempt := 0; ; attempt++ {
+			err := callback(msg)
+			if err == nil {
+				return
+			}
+
+			if attempt >= bind.retries {
+				m.checkErr(err, ErrorHandler, fmt.Sprintf("handler for %q failed on message %d after %d attempts",
+					bind.Match, msg.RowID, attempt+1))
+				return
+			}
+
+			m.ErrorLog.Printf("handler for %q failed on message %d, retrying in %v: %v", bind.Match, msg.RowID, backoff, err)
+			m.Clock.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// IncomingFromCall is the same as IncomingCall, except the callback only runs for
+// messages sent from `handle`. Use this to only respond to trusted senders.
+func (m *Messages) IncomingFromCall(handle, match string, callback Callback, opts ...BindOption) error {
+	return m.IncomingCall(match, callback, append(opts, WithFrom(handle))...)
+}
+
+// IncomingOnce connects a callback function to a matched string in a message, like
+// IncomingCall, except the callback runs for only one message and is then removed.
+// Useful for interactive flows, like "reply YES to confirm."
+func (m *Messages) IncomingOnce(match string, callback Callback, opts ...BindOption) error {
+	return m.IncomingCall(match, callback, append(opts, func(b *binding) { b.once = true })...)
+}
+
+// IncomingDefault sets a callback that runs in a go routine for messages that no other
+// channel or callback matched. Useful for "I didn't understand that" replies.
+// Only one default callback may be set; pass nil to remove it.
+func (m *Messages) IncomingDefault(callback Callback) {
+	m.binds.Lock()
+	defer m.binds.Unlock()
+
+	m.Default = callback
 }
 
 // RemoveChan deletes a message match to channel made with IncomingChan().
@@ -107,161 +330,750 @@ func (m *Messages) RemoveCall(match string) int {
 	return removed
 }
 
-// processIncomingMessages starts the iMessage-sqlite3 db watcher routine(s).
-//
-//nolint:wrapcheck
-func (m *Messages) processIncomingMessages() error {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return err
-	}
+// processIncomingMessages passes messages from the Source to the bindings until the Source stops.
+// Each database's cursor is saved after its messages were handled, once no more are waiting.
+func (m *Messages) processIncomingMessages(messages <-chan Incoming) {
+	handled := make(map[string]int64) // database path -> ID of the last message handled.
 
-	go func() {
-		m.fsnotifySQL(watcher, time.NewTicker(DefaultDuration))
-		_ = watcher.Close()
-	}()
+	for msg := range messages {
+		m.handleIncoming(msg)
+
+		if msg.Source != "" && !msg.Edited && !msg.Retracted {
+			handled[msg.Source] = msg.RowID
+		}
+
+		if len(messages) > 0 {
+			continue
+		}
 
-	return watcher.Add(filepath.Dir(m.SQLPath))
+		for path, id := range handled {
+			m.saveCursor(path, id)
+			delete(handled, path)
+		}
+	}
 }
 
-func (m *Messages) fsnotifySQL(watcher *fsnotify.Watcher, ticker *time.Ticker) {
-	for checkDB := false; ; {
+// fsnotifySQL checks the databases for new messages after they are written, until stop is closed.
+// New messages are sent to inChan.
+func (m *Messages) fsnotifySQL(watcher *fsnotify.Watcher, ticker Ticker, stop chan struct{}, inChan chan<- Incoming) {
+	var (
+		// Databases with a write event, waiting for the debounce timer to be checked.
+		checkDB = make(map[*source]bool)
+		// Fires Debounce after the last write event, or interval after the first one.
+		debounce = m.Clock.NewTimer(time.Hour)
+		interval = m.getInterval()
+		// When the first write event that has not been checked arrived.
+		firstWrite time.Time
+		// Databases that were created, renamed or removed, waiting to be re-opened.
+		resetDB = make(map[*source]bool)
+		// These become nil if the watcher fails, and every database is polled instead.
+		events = watcher.Events
+		errs   = watcher.Errors
+	)
+
+	debounce.Stop() // Started by the first write event.
+
+	for {
 		select {
-		case msg, ok := <-m.inChan:
-			if !ok {
-				return
+		case <-stop:
+			ticker.Stop()
+			return
+		case <-m.intervalSet:
+			interval = m.getInterval()
+			ticker.Reset(interval)
+		case <-debounce.Chan():
+			firstWrite = time.Time{}
+
+			for src := range checkDB {
+				delete(checkDB, src)
+				m.checkForNewMessages(src, inChan)
+			}
+		case <-ticker.Chan():
+			if events == nil {
+				m.pollSQL(inChan)
+				continue
 			}
 
-			m.handleIncoming(msg)
-		case <-ticker.C:
-			if checkDB {
-				m.checkForNewMessages()
+			for src := range resetDB {
+				if m.resetSource(watcher, src) {
+					delete(resetDB, src)
+					delete(checkDB, src)
+					m.checkForNewMessages(src, inChan) // anything written since the last check.
+				}
 			}
-		case event, ok := <-watcher.Events:
+
+			for _, src := range m.sources {
+				if src.retryDue(m.Clock.Now()) {
+					m.checkForNewMessages(src, inChan)
+				}
+			}
+		case event, ok := <-events:
 			if !ok {
-				m.ErrorLog.Print("fsnotify watcher failed. message routines stopped")
-				m.Stop()
+				m.checkErr(ErrWatcherClosed, ErrorWatcher, "fsnotify watcher failed. polling the database instead")
+				events, errs = nil, nil
 
-				return
+				continue
 			}
 
-			checkDB = event.Op&fsnotify.Write == fsnotify.Write
-		case err, ok := <-watcher.Errors:
+			m.handleEvent(event, checkDB, resetDB)
+
+			if len(checkDB) > 0 {
+				firstWrite = m.debounce(debounce, firstWrite, interval)
+			}
+		case err, ok := <-errs:
 			if !ok {
-				m.ErrorLog.Print("fsnotify watcher errors failed. message routines stopped.")
-				m.Stop()
+				m.checkErr(ErrWatcherClosed, ErrorWatcher, "fsnotify watcher errors failed. polling the database instead")
+				events, errs = nil, nil
 
-				return
+				continue
 			}
 
-			m.checkErr(err, "fsnotify watcher")
+			m.checkErr(err, ErrorWatcher, "fsnotify watcher")
 		}
 	}
 }
 
-func (m *Messages) checkForNewMessages() {
-	dbase, err := m.getDB()
+// debounce restarts the timer after a write event, so the databases are checked once the writes
+// stop for Debounce, but no later than maxWait after firstWrite. Returns the new firstWrite.
+func (m *Messages) debounce(timer Timer, firstWrite time.Time, maxWait time.Duration) time.Time {
+	now := m.Clock.Now()
+	if firstWrite.IsZero() {
+		firstWrite = now
+	}
+
+	wait := m.Debounce
+	if left := maxWait - now.Sub(firstWrite); left < wait {
+		wait = left
+	}
+
+	if !timer.Stop() {
+		select {
+		case <-timer.Chan():
+		default:
+		}
+	}
+
+	timer.Reset(wait) // Fires right away if wait is negative.
+
+	return firstWrite
+}
+
+// handleEvent marks databases that need to be checked or re-opened after a file system event.
+func (m *Messages) handleEvent(event fsnotify.Event, checkDB, resetDB map[*source]bool) {
+	if event.Op&fsnotify.Write == fsnotify.Write {
+		atomic.AddInt64(&m.stats.fileEvents, 1)
+
+		for _, src := range m.sourcesIn(filepath.Dir(event.Name)) {
+			checkDB[src] = true
+		}
+	}
+
+	// The database file (or its directory) was replaced; re-open it on the next tick.
+	if event.Op&(fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+		for _, src := range m.sources {
+			if cleanPath := filepath.Clean(event.Name); cleanPath == filepath.Clean(src.path) ||
+				cleanPath == filepath.Dir(filepath.Clean(src.path)) {
+				m.DebugLog.Printf("database %s event, re-opening: %s", event.Op, src.path)
+				resetDB[src] = true
+			}
+		}
+	}
+}
+
+// unavailable logs a database that could not be read, and schedules another check.
+// Until it can be read, the watcher retries with backoff, so messages are not left
+// unread if no more write events arrive. Call with src.idLock held.
+func (m *Messages) unavailable(src *source) {
+	wait := src.failed(m.Clock.Now())
+	m.ErrorLog.Printf("database unreadable, checking again in %v: %s", wait, src.path)
+}
+
+// SetInterval changes Interval while the library is running: how often the databases are
+// polled if the file watcher fails, and the longest a burst of writes delays a check.
+// Use a longer interval to check less often during quiet hours. Safe to call any time.
+func (m *Messages) SetInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultDuration
+	}
+
+	m.intervalLock.Lock()
+	m.Interval = interval
+	m.intervalLock.Unlock()
+
+	select {
+	case m.intervalSet <- struct{}{}:
+	default: // Already signaled.
+	}
+}
+
+// getInterval returns Interval.
+func (m *Messages) getInterval() time.Duration {
+	m.intervalLock.Lock()
+	defer m.intervalLock.Unlock()
+
+	return m.Interval
+}
+
+// pollSQL checks every database for new messages. This is used when fsnotify fails.
+func (m *Messages) pollSQL(inChan chan<- Incoming) {
+	for _, src := range m.sources {
+		atomic.AddInt64(&m.stats.polls, 1)
+		m.checkForNewMessages(src, inChan)
+	}
+}
+
+// resetSource re-adds the directory watch for a database that was replaced, and
+// lowers its current ID if the new database is smaller. Returns false if the database
+// cannot be read (yet). Check the source after this returns true.
+func (m *Messages) resetSource(watcher *fsnotify.Watcher, src *source) bool {
+	if _, err := os.Stat(src.path); err != nil {
+		return false
+	}
+
+	// Adding a path that is already watched is a no-op. This restores
+	// the watch if the directory itself was removed and re-created.
+	if err := watcher.Add(filepath.Dir(src.path)); err != nil {
+		m.checkErr(err, ErrorWatcher, "re-adding watch: "+src.path)
+		return false
+	}
+
+	if err := m.resetCurrentID(src); err != nil {
+		m.checkErr(err, ErrorDatabase, "re-reading current id: "+src.path)
+		return false
+	}
+
+	return true
+}
+
+// resetCurrentID lowers the current ID to the newest message in a database that was replaced,
+// so a smaller (new or restored) database is read from its end. The ID is never raised; messages
+// written after the last check (before or after the swap) are still delivered by the next check.
+func (m *Messages) resetCurrentID(src *source) error {
+	id, err := m.maxRowID(src.path)
+	if err != nil {
+		return err
+	}
+
+	src.idLock.Lock()
+	defer src.idLock.Unlock()
+
+	if id < src.currentID {
+		m.DebugLog.Printf("replaced database is smaller, moving current id from %d to %d: %s", src.currentID, id, src.path)
+		src.currentID = id
+		src.editsSince = -1 // re-read on the next check.
+	}
+
+	return nil
+}
+
+// checkForNewMessages reads new (and edited) messages from a database, and sends them
+// to inChan, the channel of the watcher routine that runs the check. The source is not locked while the messages are sent, so a slow
+// consumer may call CurrentID(), History() and the rest without blocking the watcher.
+func (m *Messages) checkForNewMessages(src *source, inChan chan<- Incoming) {
+	// Only one check may run at a time, so no row is read (and delivered) twice,
+	// and the rows from one check are all delivered before the next check.
+	src.checkLock.Lock()
+	defer src.checkLock.Unlock()
+
+	for _, msg := range m.readNewMessages(src) {
+		inChan <- msg
+	}
+}
+
+// readNewMessages returns the messages after currentID, and any edits, and advances currentID.
+func (m *Messages) readNewMessages(src *source) []Incoming {
+	src.idLock.Lock()
+	defer src.idLock.Unlock()
+
+	start := m.Clock.Now()
+	defer func() {
+		atomic.AddInt64(&m.stats.checks, 1)
+		atomic.AddInt64(&m.stats.checkTime, int64(m.since(start)))
+	}()
+
+	dbase, err := m.getDBPath(src.path)
 	if err != nil || dbase == nil {
-		return // error
+		m.unavailable(src)
+		return nil // error
 	}
 
 	defer m.closeDB(dbase)
 
-	sql := `SELECT message.rowid as rowid, handle.id as handle, cache_has_attachments, message.text as text, message.group_title as group ` +
-		`FROM message INNER JOIN handle ON message.handle_id = handle.ROWID ` +
-		`WHERE is_from_me=0 AND message.rowid > $id ORDER BY message.date ASC`
+	sql := messageSQL(m.incomingWhere(`message.rowid > $id`), `message.rowid ASC`)
 
-	query, _, err := dbase.PrepareTransient(sql)
+	query, sql, err := m.prepareMessages(dbase, sql, &src.noReplies)
 	if err != nil {
-		return
+		m.checkErr(err, ErrorDatabase, sql)
+		m.unavailable(src)
+
+		return nil
 	}
 
-	query.SetInt64("$id", m.currentID)
+	// Update Current ID (for the next SELECT), and collect each message for the processors.
+	// Rows arrive in rowid order, even if their dates are equal or out of order, so
+	// the ID only moves forward and a row is never selected again. If the database
+	// is busy the query restarts after the last collected message.
+	var (
+		delivered = src.currentID // Edits are only delivered for messages read before now.
+		messages  []Incoming
+	)
 
-	for {
-		if hasRow, err := query.Step(); err != nil {
-			m.ErrorLog.Printf("%s: %q\n", sql, err)
-			return
-		} else if !hasRow {
-			m.checkErr(query.Finalize(), "query reset")
+	err = m.stepRows(query, func(query *sqlite.Stmt) {
+		query.SetInt64("$id", src.currentID)
+		bindParams(query, m.IncomingParams)
+	}, func(query *sqlite.Stmt) {
+		msg := m.scanMessage(dbase, query)
+		msg.Source = src.path
+
+		if msg.RowID > src.currentID {
+			src.currentID = msg.RowID
+		}
+
+		if m.selfTestReceived(&msg) {
+			return // Sent to this account by SelfTest, probably from an IgnoreHandles handle.
+		}
+
+		if m.ignored[NormalizeHandle(msg.RawFrom, m.CountryCode)] {
+			m.DebugLog.Printf("ignoring message %d from own handle %s", msg.RowID, msg.RawFrom)
 			return
 		}
 
-		// Update Current ID (for the next SELECT), and send this message to the processors.
-		m.currentID = query.GetInt64("rowid")
-		m.inChan <- Incoming{
-			RowID: m.currentID,
-			From:  strings.TrimSpace(query.GetText("handle")),
-			Text:  strings.TrimSpace(query.GetText("text")),
-			Group: strings.TrimSpace(query.GetText("group")),
-			File:  query.GetInt64("cache_has_attachments") == 1,
+		atomic.AddInt64(&m.stats.received, 1)
+
+		messages = append(messages, msg)
+	})
+	m.checkErr(err, ErrorDatabase, sql)
+
+	if err == nil && src.failures > 0 {
+		m.ErrorLog.Printf("database readable again after %d failed checks: %s", src.failures, src.path)
+		src.failures = 0
+	}
+
+	return append(messages, m.checkEdits(dbase, src, delivered)...)
+}
+
+// messageSQL returns a SELECT statement for the columns read by scanMessage.
+// Pass in the WHERE and ORDER BY clauses, and any extra columns to select.
+func messageSQL(where, order string, columns ...string) string {
+	extra := ""
+	if len(columns) > 0 {
+		extra = strings.Join(columns, ", ") + ", "
+	}
+
+	return `SELECT ` + extra + `message.rowid as rowid, message.guid as guid, handle.id as handle, ` +
+		`cache_has_attachments, message.text as text, message.subject as subject, message.date as date, ` +
+		`associated_message_type, associated_message_guid, ` +
+		`message.is_from_me as is_from_me, message.group_title as group_title, ` +
+		`chat.guid as chat_guid, chat.display_name as chat_name, ` +
+		`message.handle_id as handle_id, chat.ROWID as chat_id, ` +
+		`message.attributedBody as attributed_body, message.destination_caller_id as destination, ` +
+		`message.is_audio_message as is_audio, message.expressive_send_style_id as expressive_style, ` +
+		replyColumn + ` as reply_to, ` +
+		`COALESCE(NULLIF(message.service, ''), NULLIF(chat.service_name, ''), handle.service) as service ` +
+		`FROM message LEFT JOIN handle ON message.handle_id = handle.ROWID ` +
+		`LEFT JOIN chat_message_join ON chat_message_join.message_id = message.ROWID ` +
+		`LEFT JOIN chat ON chat.ROWID = chat_message_join.chat_id ` +
+		`WHERE ` + where + ` ORDER BY ` + order
+}
+
+// replyColumn is the message column with the GUID of the message a threaded reply is to.
+const replyColumn = `message.thread_originator_guid`
+
+// prepareMessages prepares a messageSQL query. Databases from before threaded replies
+// (macOS 11) have no replyColumn; every message in them is read with no ReplyToGUID.
+// If noReplies is not nil, it remembers that, so the column is not tried again.
+// Returns the statement that was prepared.
+func (m *Messages) prepareMessages(dbase *sqlite.Conn, sql string, noReplies *bool) (*sqlite.Stmt, string, error) {
+	if noReplies != nil && *noReplies {
+		sql = strings.Replace(sql, replyColumn, `NULL`, 1)
+	}
+
+	query, _, err := dbase.PrepareTransient(sql)
+	if err != nil && strings.Contains(err.Error(), "no such column: "+replyColumn) {
+		m.DebugLog.Print("database has no threaded reply column, replies are not read")
+
+		if noReplies != nil {
+			*noReplies = true
+		}
+
+		sql = strings.Replace(sql, replyColumn, `NULL`, 1)
+		query, _, err = dbase.PrepareTransient(sql)
+	}
+
+	return query, sql, err //nolint:wrapcheck
+}
+
+// scanMessage turns the current row from a messageSQL query into an Incoming message.
+func (m *Messages) scanMessage(dbase *sqlite.Conn, query *sqlite.Stmt) Incoming {
+	msg := Incoming{
+		RowID:    query.GetInt64("rowid"),
+		GUID:     query.GetText("guid"),
+		HandleID: query.GetInt64("handle_id"),
+		ChatID:   query.GetInt64("chat_id"),
+		RawFrom:  strings.TrimSpace(query.GetText("handle")),
+		Text:     strings.TrimSpace(query.GetText("text")),
+		Subject:  strings.TrimSpace(query.GetText("subject")),
+		Date:     appleTime(query.GetInt64("date")),
+		Service:  strings.TrimSpace(query.GetText("service")),
+		Group:    strings.TrimSpace(query.GetText("group_title")),
+		ChatGUID: strings.TrimSpace(query.GetText("chat_guid")),
+		ChatName: strings.TrimSpace(query.GetText("chat_name")),
+		FromMe:   query.GetInt64("is_from_me") == 1,
+		IsAudio:  query.GetInt64("is_audio") == 1,
+		Effect:   styleEffect(query.GetText("expressive_style")),
+	}
+
+	if query.GetInt64("cache_has_attachments") == 1 {
+		msg.Files = m.getAttachments(dbase, msg.RowID)
+	}
+
+	msg.From = m.normalizeHandle(msg.RawFrom)
+	msg.FromName = m.contactName(msg.RawFrom)
+	msg.File = len(msg.Files) > 0
+	msg.Reaction = parseReaction(query.GetInt64("associated_message_type"), query.GetText("associated_message_guid"))
+	msg.ReplyToGUID = strings.TrimSpace(query.GetText("reply_to"))
+
+	if length := query.GetLen("attributed_body"); length > 0 {
+		blob := make([]byte, length)
+		query.GetBytes("attributed_body", blob)
+
+		if body, err := parseAttributedBody(blob); err != nil {
+			m.DebugLog.Printf("message %d: attributedBody: %v", msg.RowID, err)
+		} else {
+			msg.Mentioned = m.mentioned(body.Mentions, query.GetText("destination"))
+
+			// Newer macOS versions often leave the text column empty.
+			if msg.Text == "" {
+				msg.Text = strings.TrimSpace(body.Text)
+			}
+		}
+	}
+
+	return msg
+}
+
+// mentioned returns true if any of the mentioned handles is the handle the message was sent to.
+func (m *Messages) mentioned(mentions []string, destination string) bool {
+	if destination == "" {
+		return false
+	}
+
+	destination = NormalizeHandle(destination, m.CountryCode)
+
+	for _, handle := range mentions {
+		if NormalizeHandle(handle, m.CountryCode) == destination {
+			return true
+		}
+	}
+
+	return false
+}
+
+// appleTime converts a date from the iMessage database into a Go time.
+// Handles both the legacy seconds format and the newer nanoseconds format.
+func appleTime(date int64) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+
+	if date >= nanoDateMin {
+		return time.Unix(appleEpoch, date).UTC()
+	}
+
+	return time.Unix(appleEpoch+date, 0).UTC()
+}
+
+// getCurrentIDs gets the current ID for every watched database.
+func (m *Messages) getCurrentIDs() error {
+	for _, src := range m.sources {
+		if err := m.getCurrentID(src); err != nil {
+			return fmt.Errorf("%s: %w", src.path, err)
 		}
 	}
+
+	return nil
 }
 
-// getCurrentID opens the iMessage DB and gets the last written / current ID.
+// getCurrentID opens an iMessage DB and gets the last written / current ID.
 //
 //nolint:wrapcheck
-func (m *Messages) getCurrentID() error {
+func (m *Messages) getCurrentID(src *source) error {
+	id, err := m.maxRowID(src.path)
+	if err != nil {
+		return err
+	}
+
+	src.idLock.Lock()
+	defer src.idLock.Unlock()
+
+	src.currentID = id
+
+	if dbase, err := m.getDBPath(src.path); err == nil {
+		m.readEditsSince(dbase, src)
+		m.closeDB(dbase)
+	}
+
+	return nil
+}
+
+// maxRowID returns the highest message row id in a database.
+//
+//nolint:wrapcheck
+func (m *Messages) maxRowID(path string) (int64, error) {
 	sql := `SELECT MAX(rowid) AS id FROM message`
 
-	dbase, err := m.getDB()
+	dbase, err := m.getDBPath(path)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	defer m.closeDB(dbase)
 
 	query, _, err := dbase.PrepareTransient(sql)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	m.DebugLog.Print("querying current id")
 
 	if hasrow, err := query.Step(); err != nil {
-		m.ErrorLog.Printf("%s: %q\n", sql, err)
-		return err
+		m.checkErr(err, ErrorDatabase, sql)
+		return 0, err
 	} else if !hasrow {
 		_ = query.Finalize()
-		return ErrNoRows
+		return 0, ErrNoRows
 	}
 
-	m.currentID = query.GetInt64("id")
+	id := query.GetInt64("id")
 
-	return query.Finalize()
+	return id, query.Finalize()
 }
 
 // handleIncoming runs the call back funcs and notifies the call back channels.
 func (m *Messages) handleIncoming(msg Incoming) {
 	m.DebugLog.Printf("new message id %d from: %s size: %d", msg.RowID, msg.From, len(msg.Text))
 
+	if m.selfTestReceived(&msg) {
+		return // From a custom Source.
+	}
+
+	if m.recent.has(msg.Text) {
+		m.DebugLog.Printf("ignoring message id %d: same text as a recently sent message", msg.RowID)
+		return
+	}
+
+	msg, keep := m.runMiddleware(msg)
+	if !keep {
+		m.DebugLog.Printf("message id %d dropped by middleware", msg.RowID)
+		return
+	}
+
+	if m.AttachmentDir != "" {
+		if _, err := msg.SaveAttachments(m.AttachmentDir); err != nil {
+			m.checkErr(err, ErrorAttachment, fmt.Sprintf("saving attachments for message %d", msg.RowID))
+		}
+	}
+
+	if m.runBinds(msg) {
+		m.removeSpent()
+	}
+}
+
+// runBinds runs the matching call back funcs and channels for a message.
+// Returns true if a once binding matched and needs to be removed.
+// The bindings are not locked while they run, so a binding that waits for a
+// concurrency slot or a full channel does not block adding or removing bindings.
+func (m *Messages) runBinds(msg Incoming) bool {
+	funcs, chans, fallback := m.matchBinds(&msg)
+	spent := false
+
+	for _, bind := range funcs {
+		spent = spent || bind.once
+
+		m.DebugLog.Printf("found matching message handler func: %v", bind.Match)
+		m.runFunc(bind, msg)
+	}
+
+	for _, bind := range chans {
+		m.DebugLog.Printf("found matching message handler chan: %v", bind.Match)
+		m.sendChan(bind, msg)
+	}
+
+	if fallback != nil {
+		m.DebugLog.Print("no matching message handlers, running default handler")
+
+		go fallback(msg)
+	}
+
+	return spent
+}
+
+// matchBinds returns the funcs and channels bound to a message, or the default
+// callback if nothing matched. With SkipEmptyText, messages without text only
+// match IncomingMatch bindings.
+func (m *Messages) matchBinds(msg *Incoming) ([]*funcBinding, []*chanBinding, Callback) {
 	m.binds.RLock()
 	defer m.binds.RUnlock()
 
-	// Handle call back functions.
+	var (
+		funcs  []*funcBinding
+		chans  []*chanBinding
+		noText = m.SkipEmptyText && strings.TrimSpace(msg.Text) == ""
+	)
+
+	if noText {
+		m.DebugLog.Printf("message id %d has no text, only running IncomingMatch handlers", msg.RowID)
+	}
+
 	for _, bind := range m.Funcs {
-		if matched, err := regexp.MatchString(bind.Match, msg.Text); err != nil {
-			m.ErrorLog.Printf("%s: %q\n", bind.Match, err)
-			continue
-		} else if !matched {
-			continue
+		if (!noText || bind.custom) && bind.matches(msg) {
+			funcs = append(funcs, bind)
 		}
-
-		go bind.Func(msg)
-		m.DebugLog.Printf("found matching message handler func: %v", bind.Match)
 	}
 
-	// Handle call back channels.
 	for _, bind := range m.Chans {
-		if matched, err := regexp.MatchString(bind.Match, msg.Text); err != nil {
-			m.ErrorLog.Printf("%s: %q\n", bind.Match, err)
-			continue
-		} else if !matched {
-			continue
+		if !noText && bind.matches(msg) {
+			chans = append(chans, bind)
 		}
+	}
 
-		m.DebugLog.Printf("found matching message handler chan: %v", bind.Match)
+	if len(funcs) == 0 && len(chans) == 0 && !noText {
+		return nil, nil, m.Default
+	}
+
+	return funcs, chans, nil
+}
+
+// sendChan sends a message to a channel binding. This blocks until the channel has
+// room, or drops the message if the binding is NonBlocking.
+func (m *Messages) sendChan(bind *chanBinding, msg Incoming) {
+	if !bind.nonBlocking {
 		bind.Chan <- msg
+		return
+	}
+
+	select {
+	case bind.Chan <- msg:
+	default:
+		atomic.AddInt64(&m.stats.dropped, 1)
+		m.ErrorLog.Printf("channel for %q is full, dropped message %d", bind.Match, msg.RowID)
+	}
+}
+
+// runFunc runs a callback binding in a go routine. If the binding has a concurrency
+// limit, this waits for a slot first, or drops the message if the binding is NonBlocking.
+func (m *Messages) runFunc(bind *funcBinding, msg Incoming) {
+	if bind.limit == nil {
+		go bind.Func(msg)
+		return
+	}
+
+	if !bind.nonBlocking {
+		bind.limit <- struct{}{}
+	} else {
+		select {
+		case bind.limit <- struct{}{}:
+		default:
+			atomic.AddInt64(&m.stats.dropped, 1)
+			m.ErrorLog.Printf("handler for %q is busy, dropped message %d", bind.Match, msg.RowID)
+
+			return
+		}
+	}
+
+	go func() {
+		defer func() { <-bind.limit }()
+		bind.Func(msg)
+	}()
+}
+
+// removeSpent deletes once bindings that have already matched a message.
+func (m *Messages) removeSpent() {
+	m.binds.Lock()
+	defer m.binds.Unlock()
+
+	funcs := m.Funcs[:0]
+
+	for _, bind := range m.Funcs {
+		if !bind.spent() {
+			funcs = append(funcs, bind)
+		}
+	}
+
+	for i := len(funcs); i < len(m.Funcs); i++ {
+		m.Funcs[i] = nil // allow garbage collection.
+	}
+
+	m.Funcs = funcs
+}
+
+// ErrInvalidFilter is returned by Init when IncomingFilter or IncomingParams can not be used.
+var ErrInvalidFilter = fmt.Errorf("invalid incoming filter")
+
+// incomingWhere returns the WHERE clause that selects incoming messages, and the rows expression.
+func (m *Messages) incomingWhere(rows string) string {
+	// Messages from me have no handle in group chats, so only check it on messages from others.
+	where := `message.is_from_me=0 AND handle.ROWID IS NOT NULL AND ` + rows
+	if m.IncludeFromMe {
+		where = `(message.is_from_me=1 OR handle.ROWID IS NOT NULL) AND ` + rows
+	}
+
+	if m.IncomingFilter != "" {
+		where += ` AND (` + m.IncomingFilter + `)`
+	}
+
+	return where
+}
+
+// checkFilter makes sure IncomingFilter is a single expression, and IncomingParams can be bound.
+// Every parameter must be used in the filter; binding one that is not fails every query.
+// This does not make an unsafe filter safe; it only catches the obvious ways to escape the WHERE clause.
+func (c *Config) checkFilter() error {
+	if strings.Contains(c.IncomingFilter, ";") ||
+		strings.Contains(c.IncomingFilter, "--") ||
+		strings.Contains(c.IncomingFilter, "/*") {
+		return fmt.Errorf("%w: separators and comments are not allowed", ErrInvalidFilter)
+	}
+
+	if strings.Count(c.IncomingFilter, "(") != strings.Count(c.IncomingFilter, ")") {
+		return fmt.Errorf("%w: unbalanced parentheses", ErrInvalidFilter)
+	}
+
+	for name, val := range c.IncomingParams {
+		if name == "$id" || !strings.HasPrefix(name, "$") {
+			return fmt.Errorf("%w: parameter name %q must start with $ and not be $id", ErrInvalidFilter, name)
+		}
+
+		if !regexp.MustCompile(regexp.QuoteMeta(name) + `($|[^\w$])`).MatchString(c.IncomingFilter) {
+			return fmt.Errorf("%w: parameter %s is not used in the filter", ErrInvalidFilter, name)
+		}
+
+		switch val.(type) {
+		case nil, string, bool, int, int64, float64:
+		default:
+			return fmt.Errorf("%w: parameter %s has unsupported type %T", ErrInvalidFilter, name, val)
+		}
+	}
+
+	return nil
+}
+
+// bindParams binds named parameters to a query. Types are checked by checkFilter.
+func bindParams(query *sqlite.Stmt, params map[string]interface{}) {
+	for name, val := range params {
+		switch val := val.(type) {
+		case nil:
+			query.SetNull(name)
+		case string:
+			query.SetText(name, val)
+		case bool:
+			query.SetBool(name, val)
+		case int:
+			query.SetInt64(name, int64(val))
+		case int64:
+			query.SetInt64(name, val)
+		case float64:
+			query.SetFloat(name, val)
+		}
 	}
 }
@@ -0,0 +1,390 @@
+package imessage
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckForNewMessagesConcurrent(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{})
+
+	const rows = 50
+	for i := 0; i < rows; i++ {
+		addTestMessage(t, m.SQLPath, 1, 1, "hello", int64(i))
+	}
+
+	inChan := make(chan Incoming, rows*2)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			m.checkForNewMessages(m.primary(), inChan)
+		}()
+	}
+
+	wg.Wait()
+	close(inChan)
+
+	var last int64
+
+	count := 0
+
+	for msg := range inChan {
+		if msg.RowID <= last {
+			t.Errorf("message %d delivered after %d", msg.RowID, last)
+		}
+
+		last = msg.RowID
+		count++
+	}
+
+	if count != rows {
+		t.Errorf("delivered %d messages, want %d", count, rows)
+	}
+
+	if id := m.CurrentID(); id != rows {
+		t.Errorf("CurrentID() = %d, want %d", id, rows)
+	}
+}
+
+// A consumer that reads the current ID while it handles each message must not block the watcher.
+func TestCheckForNewMessagesSlowConsumer(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{})
+
+	const rows = 30
+	for i := 0; i < rows; i++ {
+		addTestMessage(t, m.SQLPath, 1, 1, "hello", int64(i))
+	}
+
+	inChan := make(chan Incoming)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for range inChan {
+			_ = m.CurrentID()
+
+			if _, err := m.History("iMessage;-;+15551234567", 1); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	finished := make(chan struct{})
+
+	go func() {
+		m.checkForNewMessages(m.primary(), inChan)
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("checkForNewMessages blocked on a consumer calling CurrentID")
+	}
+
+	close(inChan)
+	<-done
+}
+
+// Messages are delivered in rowid order, even when they share a date or the dates go backwards.
+func TestCheckForNewMessagesSameDate(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{})
+	inChan := make(chan Incoming, 10)
+
+	want := []int64{
+		addTestMessage(t, m.SQLPath, 1, 1, "first", 5),
+		addTestMessage(t, m.SQLPath, 1, 1, "second", 5),
+		addTestMessage(t, m.SQLPath, 2, 2, "third", 5),
+	}
+
+	m.checkForNewMessages(m.primary(), inChan)
+
+	// Written after the first check, with an older date.
+	want = append(want, addTestMessage(t, m.SQLPath, 1, 1, "fourth", 1), addTestMessage(t, m.SQLPath, 1, 1, "fifth", 5))
+
+	m.checkForNewMessages(m.primary(), inChan)
+	close(inChan)
+
+	var got []int64
+	for msg := range inChan {
+		got = append(got, msg.RowID)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("delivered %v, want %v", got, want)
+		}
+	}
+}
+
+// When chat.db is replaced, messages in the new file after the current ID are delivered,
+// and a smaller database is read from its end.
+func TestDatabaseSwap(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{Interval: 20 * time.Millisecond})
+	addTestMessage(t, m.SQLPath, 1, 1, "old 1", 1)
+	addTestMessage(t, m.SQLPath, 1, 1, "old 2", 2)
+
+	got := make(chan Incoming, 10)
+	if err := m.IncomingChan(".*", got); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Stop()
+
+	swap := func(texts ...string) {
+		t.Helper()
+
+		path := newTestDB(t)
+		for i, text := range texts {
+			addTestMessage(t, path, 1, 1, text, int64(i))
+		}
+
+		if err := os.Rename(path, m.SQLPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(texts ...string) {
+		t.Helper()
+
+		for _, text := range texts {
+			select {
+			case msg := <-got:
+				if msg.Text != text {
+					t.Fatalf("got message %q, want %q", msg.Text, text)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("message %q was not delivered", text)
+			}
+		}
+	}
+
+	// A bigger copy, with two messages written after the last check.
+	swap("old 1", "old 2", "new 3", "new 4")
+	expect("new 3", "new 4")
+
+	// A smaller, new database.
+	swap("fresh 1")
+	time.Sleep(200 * time.Millisecond) // let the watcher re-open it.
+	addTestMessage(t, m.SQLPath, 1, 1, "fresh 2", 1)
+	expect("fresh 2")
+}
+
+// A binding waiting for a concurrency slot must not block changing the bindings.
+func TestRunBindsLimitUnlocked(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{})
+	release := make(chan struct{})
+	started := make(chan struct{}, 2) //nolint:gomnd
+
+	err := m.IncomingCall(".*", func(Incoming) {
+		started <- struct{}{}
+		<-release
+	}, MaxConcurrent(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan struct{})
+
+	go func() {
+		defer close(handled)
+		m.handleIncoming(Incoming{RowID: 1, Text: "one"})
+		m.handleIncoming(Incoming{RowID: 2, Text: "two"}) // Waits for the first to finish.
+	}()
+
+	<-started
+	time.Sleep(50 * time.Millisecond) // Let the second message wait for the slot.
+
+	bound := make(chan struct{})
+
+	go func() {
+		defer close(bound)
+
+		_ = m.IncomingCall("other", func(Incoming) {})
+		m.RemoveCall("other")
+	}()
+
+	select {
+	case <-bound:
+	case <-time.After(5 * time.Second):
+		t.Error("changing bindings blocked while a binding waited for a slot")
+	}
+
+	close(release)
+	<-handled
+}
+
+// Databases without the threaded reply and edit columns are still read.
+func TestOldSchema(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{SQLPath: newOldTestDB(t)})
+	inChan := make(chan Incoming, 10) //nolint:gomnd
+	src := m.primary()
+
+	addTestMessage(t, m.SQLPath, 1, 1, "one", 1)
+	addTestMessage(t, m.SQLPath, 1, 1, "two", 2) //nolint:gomnd
+	m.checkForNewMessages(src, inChan)
+	m.checkForNewMessages(src, inChan) // Again, after the missing columns were found.
+	close(inChan)
+
+	var texts []string
+	for msg := range inChan {
+		texts = append(texts, msg.Text)
+	}
+
+	if expect := []string{"one", "two"}; !reflect.DeepEqual(texts, expect) {
+		t.Errorf("got messages %q, expected %q", texts, expect)
+	}
+
+	if !src.noReplies || !src.noEdits {
+		t.Errorf("missing columns were not found: noReplies %v, noEdits %v", src.noReplies, src.noEdits)
+	}
+
+	history, err := m.History("iMessage;-;+15551234567", 10) //nolint:gomnd
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != 2 { //nolint:gomnd
+		t.Errorf("got %d messages from History, expected 2", len(history))
+	}
+
+	if latest, err := m.LatestPerChat(); err != nil || len(latest) != 1 {
+		t.Errorf("LatestPerChat returned %d messages and error %v, expected 1", len(latest), err)
+	}
+}
+
+// Restarting while the previous routines are still running must not send their messages to
+// the new routines' channels, or let two outgoing routines run at once.
+func TestRestart(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{Interval: time.Millisecond, SendDelay: time.Millisecond})
+	received := make(chan Incoming, 100) //nolint:gomnd
+
+	if err := m.IncomingChan(".*", received); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	sending := make(chan struct{})
+
+	go func() { // Send and check the queue during every restart.
+		defer close(sending)
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = m.TrySend(Outgoing{To: "+15551234567", Text: "hi"})
+				_ = m.QueueDepth()
+				m.Cancel("none")
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		addTestMessage(t, m.SQLPath, 1, 1, "hello", int64(i))
+		time.Sleep(time.Millisecond)
+		m.Stop()
+	}
+
+	close(stop)
+	<-sending
+}
+
+// Every parameter must be used by the filter, or binding it fails every query.
+func TestCheckFilter(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		filter string
+		params map[string]interface{}
+		valid  bool
+	}{
+		"empty":       {valid: true},
+		"used":        {filter: `handle.id = $from`, params: map[string]interface{}{"$from": "bob"}, valid: true},
+		"last":        {filter: `(handle.id=$from)`, params: map[string]interface{}{"$from": "bob"}, valid: true},
+		"unused":      {filter: `handle.id = 'bob'`, params: map[string]interface{}{"$from": "bob"}},
+		"no filter":   {params: map[string]interface{}{"$from": "bob"}},
+		"prefix only": {filter: `handle.id = $fromme`, params: map[string]interface{}{"$from": "bob"}},
+		"comment":     {filter: `1 -- comment`},
+		"bad type":    {filter: `handle.id = $from`, params: map[string]interface{}{"$from": []string{"bob"}}},
+	}
+
+	for name, test := range tests {
+		config := Config{IncomingFilter: test.filter, IncomingParams: test.params}
+
+		err := config.checkFilter()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		} else if !test.valid && !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("%s: got error %v, expected ErrInvalidFilter", name, err)
+		}
+	}
+}
+
+// Messages from me in group chats have no handle, and are delivered with IncludeFromMe.
+func TestIncomingFromMeGroup(t *testing.T) {
+	t.Parallel()
+
+	for _, fromMe := range []bool{false, true} {
+		m := newTestMessages(t, &Config{IncludeFromMe: fromMe})
+		inChan := make(chan Incoming, 10) //nolint:gomnd
+
+		addTestMessage(t, m.SQLPath, 2, 2, "theirs", 1)
+		addTestMessage(t, m.SQLPath, 0, 2, "mine", 2)      //nolint:gomnd
+		addTestMessage(t, m.SQLPath, 0, 1, "no handle", 3) //nolint:gomnd
+		execTestDB(t, m.SQLPath, `UPDATE message SET is_from_me = 1 WHERE text = 'mine'`)
+		m.checkForNewMessages(m.primary(), inChan)
+		close(inChan)
+
+		var texts []string
+		for msg := range inChan {
+			texts = append(texts, msg.Text)
+		}
+
+		expect := []string{"theirs"}
+		if fromMe {
+			expect = append(expect, "mine")
+		}
+
+		if !reflect.DeepEqual(texts, expect) {
+			t.Errorf("IncludeFromMe %v: got messages %q, expected %q", fromMe, texts, expect)
+		}
+	}
+}
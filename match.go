@@ -0,0 +1,253 @@
+package imessage
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MatchMode controls how the match string on a binding is compared to incoming message text.
+type MatchMode int
+
+// These are the available match modes. MatchRegexp is the default.
+const (
+	// MatchRegexp treats the match string as a regular expression.
+	MatchRegexp MatchMode = iota
+	// MatchSubstring matches messages that contain the match string.
+	MatchSubstring
+	// MatchExact matches messages that are exactly equal to the match string.
+	MatchExact
+	// MatchGlob treats the match string as a shell-style glob. * matches anything, ? matches one character.
+	MatchGlob
+	// MatchRegexpNoCase treats the match string as a case-insensitive regular expression.
+	MatchRegexpNoCase
+)
+
+// BindOption is passed into IncomingCall and IncomingChan to modify a binding.
+type BindOption func(*binding)
+
+// WithMatchMode changes how a binding's match string is compared to message text.
+func WithMatchMode(mode MatchMode) BindOption {
+	return func(b *binding) {
+		b.Mode = mode
+	}
+}
+
+// WithFrom restricts a binding to messages from a specific sender handle,
+// like a phone number or email address. The text must still match.
+func WithFrom(handle string) BindOption {
+	return func(b *binding) {
+		b.From = handle
+	}
+}
+
+// WithFromName restricts a binding to messages from a sender with this name in Contacts,
+// like "Mom". Names are compared without case. This needs Config.ResolveNames; without it,
+// messages have no FromName, and the binding never matches. The text must still match.
+func WithFromName(name string) BindOption {
+	return func(b *binding) {
+		b.FromName = strings.TrimSpace(name)
+	}
+}
+
+// MatchNormalized compares the match string to a normalized copy of the message text:
+// lowercase, with smart quotes turned into plain quotes, and runs of whitespace collapsed
+// to one space. Incoming.Text is not changed. With MatchSubstring, MatchExact and MatchGlob
+// the match string is normalized too; regular expressions are used as written.
+func MatchNormalized() BindOption {
+	return func(b *binding) {
+		b.normalized = true
+	}
+}
+
+// textNormalizer replaces smart quotes and other typographic characters with plain ones.
+//
+//nolint:gochecknoglobals
+var textNormalizer = strings.NewReplacer(
+	"\u2018", "'", "\u2019", "'", "\u201A", "'", "\u201B", "'",
+	"\u201C", `"`, "\u201D", `"`, "\u201E", `"`, "\u201F", `"`,
+	"\u2026", "...",
+)
+
+// normalizeText returns text lowercased, with plain quotes and single spaces. See MatchNormalized.
+func normalizeText(text string) string {
+	return strings.Join(strings.Fields(textNormalizer.Replace(strings.ToLower(text))), " ")
+}
+
+// NonBlocking makes a channel binding drop messages when the channel is full, instead of
+// waiting for room. A slow consumer then loses messages rather than stalling every binding
+// and the database watcher. Dropped messages are logged and counted in Stats.Dropped.
+// IncomingCall bindings only drop messages when they have a MaxConcurrent() limit.
+func NonBlocking() BindOption {
+	return func(b *binding) {
+		b.nonBlocking = true
+	}
+}
+
+// MaxConcurrent limits how many copies of an IncomingCall function may run at once.
+// When the limit is reached, incoming messages wait for one to finish, like a full
+// channel binding; with NonBlocking(), they are dropped instead. Default is unlimited.
+// This has no effect on IncomingChan bindings.
+func MaxConcurrent(limit int) BindOption {
+	return func(b *binding) {
+		b.limit = nil
+		if limit > 0 {
+			b.limit = make(chan struct{}, limit)
+		}
+	}
+}
+
+// WithRetry sets how many times an IncomingCallE callback is retried after it returns an
+// error, and how long to wait before the first retry. The wait doubles after each retry.
+// This has no effect on other bindings.
+func WithRetry(retries int, backoff time.Duration) BindOption {
+	return func(b *binding) {
+		b.retries, b.backoff = retries, backoff
+	}
+}
+
+// OnlyGroups restricts a binding to messages received in group chats.
+func OnlyGroups() BindOption {
+	return func(b *binding) {
+		b.chat = chatGroup
+	}
+}
+
+// OnlyDMs restricts a binding to messages received in one-on-one chats.
+func OnlyDMs() BindOption {
+	return func(b *binding) {
+		b.chat = chatDM
+	}
+}
+
+// chatKind restricts a binding to group chats or direct messages.
+type chatKind int
+
+const (
+	chatAny chatKind = iota
+	chatGroup
+	chatDM
+)
+
+// Predicate is a custom matching function for IncomingMatch. Return true to match the message.
+type Predicate func(msg Incoming) bool
+
+// binding holds the matching logic shared by channel and function bindings.
+type binding struct {
+	Match    string
+	Mode     MatchMode
+	From     string    // only match messages from this handle, if not empty.
+	FromName string    // only match messages from this contact name, if not empty.
+	chat     chatKind  // only match messages in group chats or DMs, if set.
+	pred     Predicate // compiled Match, or a custom predicate from IncomingMatch.
+	custom   bool      // pred is from IncomingMatch, so it sees messages without text.
+	once     bool      // remove the binding after it matches one message.
+	// nonBlocking drops messages for a full channel, instead of waiting.
+	nonBlocking bool
+	normalized  bool          // match normalized text. See MatchNormalized.
+	limit       chan struct{} // holds a value for each running callback, if limited.
+	retries     int           // how many times an IncomingCallE callback is retried.
+	backoff     time.Duration // the first wait before retrying an IncomingCallE callback.
+	fired       int32         // set to 1 (atomically) when a once binding matches.
+}
+
+// newBinding applies the options and compiles the match string into a predicate.
+func newBinding(match string, opts []BindOption) (binding, error) {
+	bind := binding{Match: match}
+	bind.apply(opts)
+
+	text := func(msg Incoming) string { return msg.Text }
+	if bind.normalized {
+		text = func(msg Incoming) string { return normalizeText(msg.Text) }
+
+		if bind.Mode != MatchRegexp && bind.Mode != MatchRegexpNoCase {
+			match = normalizeText(match)
+		}
+	}
+
+	var (
+		re  *regexp.Regexp
+		err error
+	)
+
+	switch bind.Mode {
+	case MatchSubstring:
+		bind.pred = func(msg Incoming) bool { return strings.Contains(text(msg), match) }
+		return bind, nil
+	case MatchExact:
+		bind.pred = func(msg Incoming) bool { return text(msg) == match }
+		return bind, nil
+	case MatchGlob:
+		re, err = regexp.Compile(globToRegexp(match))
+	case MatchRegexpNoCase:
+		re, err = regexp.Compile("(?i)" + match)
+	default: // MatchRegexp
+		re, err = regexp.Compile(match)
+	}
+
+	if err != nil {
+		return bind, fmt.Errorf("compiling match %q: %w", match, err)
+	}
+
+	bind.pred = func(msg Incoming) bool { return re.MatchString(text(msg)) }
+
+	return bind, nil
+}
+
+// apply runs the options on the binding.
+func (b *binding) apply(opts []BindOption) {
+	for _, opt := range opts {
+		opt(b)
+	}
+}
+
+// matches returns true if the binding matches the message provided.
+// A once binding only returns true for the first message it matches.
+func (b *binding) matches(msg *Incoming) bool {
+	if b.From != "" && !strings.EqualFold(b.From, msg.From) {
+		return false
+	}
+
+	if b.FromName != "" && !strings.EqualFold(b.FromName, msg.FromName) {
+		return false
+	}
+
+	if (b.chat == chatGroup && !msg.IsGroup()) || (b.chat == chatDM && msg.IsGroup()) {
+		return false
+	}
+
+	if b.pred == nil || !b.pred(*msg) {
+		return false
+	}
+
+	return !b.once || atomic.CompareAndSwapInt32(&b.fired, 0, 1)
+}
+
+// spent returns true if this is a once binding that already matched a message.
+func (b *binding) spent() bool {
+	return b.once && atomic.LoadInt32(&b.fired) == 1
+}
+
+// globToRegexp converts a shell-style glob into an anchored regular expression.
+func globToRegexp(glob string) string {
+	var out strings.Builder
+
+	out.WriteString("^(?s)")
+
+	for _, char := range glob {
+		switch char {
+		case '*':
+			out.WriteString(".*")
+		case '?':
+			out.WriteString(".")
+		default:
+			out.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+
+	out.WriteString("$")
+
+	return out.String()
+}
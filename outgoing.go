@@ -1,100 +1,444 @@
 package imessage
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
-	"os/exec"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode"
 )
 
-const (
-	sleepTime = 100 * time.Millisecond
-	clearTime = 2 * time.Minute
-)
+// DefaultSendDelay is the default for Config.SendDelay.
+const DefaultSendDelay = 100 * time.Millisecond
 
-// OSAScriptPath is the path to the osascript binary. macOS only.
+// DefaultClearInterval is the default for Config.ClearInterval.
+const DefaultClearInterval = 2 * time.Minute
+
+// OSAScriptPath is the path to the osascript binary, if Config.OSAScriptPath is empty. macOS only.
 //
 //nolint:gochecknoglobals
 var OSAScriptPath = "/usr/bin/osascript"
 
+// ErrNotSent is returned by SendWait when a message failed to send.
+var ErrNotSent = fmt.Errorf("message not sent")
+
+// ErrQueueFull is returned when a message is sent while the outgoing queue is full.
+var ErrQueueFull = fmt.Errorf("outgoing queue full")
+
+// ErrStopped is returned when a message is sent after Stop() or Shutdown().
+var ErrStopped = fmt.Errorf("messages stopped")
+
+// ErrCanceled is returned in a Response when a queued message is removed with Cancel.
+var ErrCanceled = fmt.Errorf("message canceled")
+
+// ErrInvalidFile is returned in a Response when a File message path is not a regular file.
+var ErrInvalidFile = fmt.Errorf("attachment is not a regular file")
+
+// ErrInvalidService is returned in a Response when Outgoing.Service is not a service that can be used.
+var ErrInvalidService = fmt.Errorf("invalid service")
+
+// These are the values Outgoing.Service accepts. They match Incoming.Service.
+const (
+	ServiceIMessage = "iMessage"
+	ServiceSMS      = "SMS"
+)
+
 // Outgoing struct is used to send a message to someone.
 // Fll it out and pass it into Messages.Send() to fire off a new iMessage.
 type Outgoing struct {
-	ID   string          // ID is only used in logging and in the Response callback.
-	To   string          // To represents the message recipient.
-	Text string          // Text is the body of the message or file path.
-	File bool            // If File is true, then Text is assume to be a filepath to send.
-	Call func(*Response) // Call is the function that is run after a message is sent off.
+	ID string `json:"id"` // ID is only used in logging and in the Response callback.
+	To string `json:"to"` // To represents the message recipient.
+	// ChatGUID sends the message to this chat, like a GUID from Chats() or Incoming.ChatGUID,
+	// instead of finding a buddy for To. This keeps the chat's service (SMS or iMessage),
+	// and works for group chats. To is optional when this is set; it defaults to ChatGUID.
+	ChatGUID string `json:"chat_guid,omitempty"`
+	// Service is the network used to reach To: ServiceIMessage (default) or ServiceSMS. SMS needs
+	// Text Message Forwarding from an iPhone, and a phone number. Case is ignored. Chats (ChatGUID,
+	// chat GUIDs and group names) keep their own service, so this is ignored for them. SMS can not
+	// be used with ShowTyping, Effect, ReplyTo or a ReactTo tapback.
+	Service string `json:"service,omitempty"`
+	Text    string `json:"text"` // Text is the body of the message or file path.
+	File    bool   `json:"file"` // If File is true, then Text is a filepath to send. It must exist.
+	// Subject is sent as the first line of the text, because AppleScript cannot set a real
+	// subject. Only used for text messages and captions.
+	Subject string `json:"subject,omitempty"`
+	// Files are more file paths to send, in order, after Text when File is true. If File is false,
+	// Text is a caption, sent after the files. Every file must exist; if any do not, nothing
+	// is sent and Response.Errs has an error for each missing file.
+	Files   []string `json:"files,omitempty"`
+	IsGroup bool     `json:"is_group"` // If IsGroup is true, To is a group chat name or GUID. GUIDs are auto-detected.
+	Retries int      `json:"retries"`  // Retries is the most send attempts, up to 10. 0 uses the Config value.
+	// Priority controls the send order of queued messages. Higher priorities are sent first.
+	// Messages with the same priority are sent in the order they were queued.
+	Priority int `json:"priority"`
+	// ShowTyping shows the typing indicator for a couple seconds before the message is sent.
+	// Only works for one-on-one chats; see SendTyping. Messages with this set are not batched.
+	ShowTyping bool            `json:"show_typing"`
+	Call       func(*Response) `json:"-"` // Call is the function that is run after a message is sent off.
+	// Effect sends a text message with a bubble or screen effect, like slam, invisibleink
+	// or confetti. See Effects() for the list. Unknown effects fail the message. Needs
+	// Accessibility access for Messages.app automation, and only works in one-on-one chats.
+	// Messages with an effect are not batched.
+	Effect string `json:"effect,omitempty"`
+	// Status is run each time a sent message's delivery status changes: when it is delivered,
+	// and when it is read. The database is checked every couple seconds until the message is read,
+	// or StatusTimeout passes. Not run if the message fails to send.
+	Status func(*Status) `json:"-"`
+	// ReactTo is the RowID of an incoming message to react to. If it is set and Text is a reaction
+	// shortcut like !love, !like, !dislike, !laugh, !emphasize or !question, the tapback is sent
+	// instead of the text. See SendReaction for its limits. Other text is sent as usual.
+	ReactTo int64 `json:"react_to,omitempty"`
+	// ReplyTo is the GUID of a message to reply to in a thread (an inline reply), like Incoming.GUID.
+	// Like SendReaction, this drives the Messages.app user interface, and only replies to the most
+	// recent incoming message in a one-on-one chat; otherwise the message is not sent and the
+	// Response has ErrReplyTarget. Ignored when File is true.
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Meta is anything the caller wants to keep with the message, like a request ID.
+	// It is not sent; it is copied to the Response, so callbacks have it.
+	Meta interface{} `json:"meta,omitempty"`
 }
 
 // Response is the outgoing-message response provided to a callback function.
 // An outgoing callback function will receive this type. It represents "what happeened"
 // when trying to send a message. If `Sent` is false, `Errs` should contain error(s).
 type Response struct {
-	ID   string
-	To   string
-	Text string
-	Sent bool
-	Errs []error
+	ID      string        `json:"id"`
+	To      string        `json:"to"`
+	Text    string        `json:"text"`
+	Sent    bool          `json:"sent"`
+	Errs    []error       `json:"-"`       // Errs has an error for each failed attempt. Script failures are *SendError.
+	Elapsed time.Duration `json:"elapsed"` // Elapsed is how long it took to run the send AppleScript(s).
+	// Output is everything osascript printed (stdout and stderr) on the last attempt.
+	// Useful for debugging; it may contain warnings even when the message was sent.
+	Output string `json:"output"`
+	// Meta is the Outgoing message's Meta.
+	Meta interface{} `json:"meta,omitempty"`
+	// Confirmed is true if the sent message was found in the database. Only checked with VerifySends.
+	Confirmed bool `json:"confirmed"`
+	// after is the highest database row id before the message was sent. Used by Status.
+	after int64
+}
+
+// Err returns nil if the message was sent. If the last attempt failed running the AppleScript,
+// Err returns that *SendError. Otherwise it returns ErrNotSent wrapped with Errs, like for a
+// missing file or a canceled message. Every error returned matches ErrNotSent with errors.Is.
+func (r *Response) Err() error {
+	if r.Sent {
+		return nil
+	}
+
+	var sendErr *SendError
+	if len(r.Errs) > 0 && errors.As(r.Errs[len(r.Errs)-1], &sendErr) {
+		return sendErr
+	}
+
+	return fmt.Errorf("%w: %v", ErrNotSent, r.Errs)
+}
+
+// responseJSON is the wire format of a Response. Errors are encoded as strings.
+type responseJSON struct {
+	*responseAlias
+	Errors []string `json:"errors,omitempty"`
+}
+
+// responseAlias has the fields of Response, without its methods.
+type responseAlias Response
+
+// MarshalJSON encodes the Response, including Errs as a list of strings named errors.
+func (r Response) MarshalJSON() ([]byte, error) {
+	out := responseJSON{responseAlias: (*responseAlias)(&r)}
+	for _, err := range r.Errs {
+		out.Errors = append(out.Errors, err.Error())
+	}
+
+	return json.Marshal(out) //nolint:wrapcheck
+}
+
+// UnmarshalJSON decodes a Response encoded by MarshalJSON. Errs only keep their text.
+func (r *Response) UnmarshalJSON(data []byte) error {
+	in := responseJSON{responseAlias: (*responseAlias)(r)}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	r.Errs = nil
+	for _, msg := range in.Errors {
+		r.Errs = append(r.Errs, errors.New(msg)) //nolint:goerr113
+	}
+
+	return nil
 }
 
 // Send is the method used to send an iMessage. Thread/routine safe.
 // The messages are queued in a channel and sent 1 at a time with a small
 // delay between. Each message may have a callback attached that is kicked
 // off in a go routine after the message is sent.
+// If the library was stopped, the message is not sent, and its Call function gets ErrStopped.
+// If MaxQueueDepth is set and the queue is full, the Call function gets ErrQueueFull.
 func (m *Messages) Send(msg Outgoing) {
-	m.outChan <- msg
+	msg = m.prepare(msg)
+
+	if err := m.queueOutgoing(context.Background(), msg, m.MaxQueueDepth < 1); err != nil && msg.Call != nil {
+		go msg.Call(msg.response(err))
+	}
+}
+
+// TrySend queues a message like Send, but never waits for room in the queue. Returns
+// ErrQueueFull if MaxQueueDepth (or QueueSize) messages are waiting, or ErrStopped.
+// The message's Call function is only run if the message was queued.
+func (m *Messages) TrySend(msg Outgoing) error {
+	return m.queueOutgoing(context.Background(), m.prepare(msg), false)
+}
+
+// QueueDepth returns how many outgoing messages are waiting to be sent.
+// Messages that are being sent are not counted.
+func (m *Messages) QueueDepth() int {
+	m.outLock.RLock()
+	defer m.outLock.RUnlock()
+
+	return m.queueDepth()
+}
+
+// queueDepth returns how many outgoing messages are waiting to be sent. Call with outLock held.
+func (m *Messages) queueDepth() int {
+	return len(m.outChan) + m.queue.depth()
+}
+
+// queueOutgoing adds a message to the outgoing channel. If block is true, it waits for room
+// until the context ends, otherwise it returns ErrQueueFull. Returns ErrStopped if the channel
+// is closed.
+func (m *Messages) queueOutgoing(ctx context.Context, msg Outgoing, block bool) error {
+	m.outLock.RLock()
+	defer m.outLock.RUnlock()
+
+	if m.outShut {
+		return ErrStopped
+	} else if m.MaxQueueDepth > 0 && m.queueDepth() >= m.MaxQueueDepth {
+		return ErrQueueFull
+	}
+
+	if !block {
+		select {
+		case m.outChan <- msg:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+
+	select {
+	case m.outChan <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err() //nolint:wrapcheck
+	}
+}
+
+// prepare normalizes an outgoing message before it is queued.
+func (m *Messages) prepare(msg Outgoing) Outgoing {
+	if msg.To == "" {
+		msg.To = msg.ChatGUID
+	}
+
+	if !msg.IsGroup && !isChatGUID(msg.To) {
+		msg.To = m.normalizeHandle(msg.To)
+	}
+
+	return msg
+}
+
+// SendWait sends an iMessage and waits for the result. The message is queued like Send(),
+// and this method blocks until the message has been sent (or failed) or the context ends.
+// If the message has a Call function, it still runs. The returned error is non-nil if the
+// message was not sent; the Response contains all of the errors from each attempt.
+func (m *Messages) SendWait(ctx context.Context, msg Outgoing) (*Response, error) {
+	reply := make(chan *Response, 1)
+	callback := msg.Call
+	msg.Call = func(resp *Response) {
+		if callback != nil {
+			callback(resp)
+		}
+
+		reply <- resp
+	}
+
+	if err := m.queueOutgoing(ctx, m.prepare(msg), m.MaxQueueDepth < 1); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-reply:
+		return resp, resp.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err() //nolint:wrapcheck
+	}
+}
+
+// SendAndAwaitReply sends an iMessage like SendWait(), then waits for the next incoming
+// message from the recipient with text matching fromMatch (a regular expression), and
+// returns it. An empty fromMatch matches any reply. Replies to a group chat may come from
+// any member. The reply is still passed to the other bindings. Returns the context's error
+// if it ends first, or SendWait's error if the message was not sent. Use this for
+// confirmation dialogs, like "reply YES to continue."
+func (m *Messages) SendAndAwaitReply(ctx context.Context, msg Outgoing, fromMatch string) (Incoming, error) {
+	if fromMatch == "" {
+		fromMatch = ".*"
+	}
+
+	bind, err := newBinding(fromMatch, nil)
+	if err != nil {
+		return Incoming{}, err
+	}
+
+	msg = m.prepare(msg)
+	bind.once = true
+	bind.pred = replyPredicate(msg, bind.pred)
+
+	if to := msg.recipient(); !msg.IsGroup && !isChatGUID(to) {
+		bind.From = to
+	}
+
+	// Bind before sending, so a quick reply is not missed.
+	reply := make(chan Incoming, 1)
+	waiter := m.bindFunc(bind, func(in Incoming) { reply <- in })
+
+	defer func() {
+		atomic.StoreInt32(&waiter.fired, 1)
+		m.removeSpent()
+	}()
+
+	if _, err := m.SendWait(ctx, msg); err != nil {
+		return Incoming{}, err
+	}
+
+	select {
+	case in := <-reply:
+		return in, nil
+	case <-ctx.Done():
+		return Incoming{}, ctx.Err() //nolint:wrapcheck
+	}
+}
+
+// replyPredicate wraps a text predicate so it only matches messages in the chat an Outgoing
+// message was sent to. Messages sent by this account never match.
+func replyPredicate(msg Outgoing, text Predicate) Predicate {
+	to := msg.recipient()
+
+	return func(in Incoming) bool {
+		switch {
+		case in.FromMe:
+			return false
+		case isChatGUID(to):
+			if !strings.EqualFold(in.ChatGUID, to) {
+				return false
+			}
+		case msg.IsGroup:
+			if !strings.EqualFold(in.ChatName, to) {
+				return false
+			}
+		}
+
+		return text(in)
+	}
 }
 
 // RunAppleScript runs a script on the local system. While not directly related to
 // iMessage and Messages.app, this library uses AppleScript to send messages using
 // imessage. To that end, the method to run scripts is also exposed for convenience.
 func (m *Messages) RunAppleScript(scripts []string) (bool, []error) {
-	arg := []string{OSAScriptPath}
-	for _, s := range scripts {
-		arg = append(arg, "-e", s)
-	}
+	_, _, success, errs := m.runAppleScript(scripts, m.Retries)
+	return success, errs
+}
+
+// RunJavaScript runs JavaScript for Automation (JXA) scripts on the local system, with
+// retries like RunAppleScript. JavaScript avoids AppleScript's string quoting rules.
+// Each script is passed to osascript with -e; they run as one program.
+func (m *Messages) RunJavaScript(scripts []string) (bool, []error) {
+	_, _, success, errs := m.runScripts(m.JSRunner, scripts, m.Retries)
+	return success, errs
+}
 
-	m.DebugLog.Printf("AppleScript Command: %v", strings.Join(arg, " "))
+// runAppleScript is RunAppleScript, but it also returns the standard output (the script's
+// result) and the combined output from the last attempt. retries is the most attempts to make.
+func (m *Messages) runAppleScript(scripts []string, retries int) (string, string, bool, []error) {
+	return m.runScripts(m.Runner, scripts, retries)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.Config.Timeout)*time.Second)
-	defer cancel()
+// runScripts runs scripts with a runner, retrying up to retries times.
+func (m *Messages) runScripts(runner ScriptRunner, scripts []string, retries int) (string, string, bool, []error) {
+	if o, ok := runner.(osascript); ok {
+		m.DebugLog.Printf("AppleScript Command: %v", strings.Join(o.args(scripts), " "))
+	} else {
+		m.DebugLog.Printf("AppleScript Command: %v", strings.Join(scripts, " "))
+	}
+
+	if m.DryRun {
+		m.DebugLog.Print("dry run, not running AppleScript")
+		return "", "", true, nil
+	}
 
 	var (
-		success bool
-		errs    []error
+		success        bool
+		errs           []error
+		stdout, output string
 	)
 
-	for i := 1; i <= m.Config.Retries && !success; i++ {
+	for i := 1; i <= retries && !success; i++ {
 		if i > 1 {
 			// we had an error, don't be so quick to try again.
-			time.Sleep(time.Second)
+			atomic.AddInt64(&m.stats.retries, 1)
+			m.Clock.Sleep(m.RetryDelay)
 		}
 
-		cmd := exec.CommandContext(ctx, arg[0], arg[1:]...) //nolint:gosec
+		var err error
 
-		var out bytes.Buffer
-		cmd.Stdout = &out
-		cmd.Stderr = &out
-
-		if err := cmd.Run(); err != nil {
-			errs = append(errs, fmt.Errorf("exec: %w: %v", err, out.String()))
+		if stdout, output, err = m.runOnce(runner, scripts); err != nil {
+			errs = append(errs, err)
 			continue
 		}
 
 		success = true
 	}
 
-	return success, errs
+	return stdout, output, success, errs
 }
 
-// ClearMessages deletes all conversations in MESSAGES.APP.
+// runOnce makes one attempt to run the scripts. Each attempt is killed after Timeout seconds,
+// so a hung osascript (like when Messages.app shows a dialog) fails and may be retried,
+// instead of blocking every other send. Errors are *SendError.
+func (m *Messages) runOnce(runner ScriptRunner, scripts []string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.Timeout)*time.Second)
+	defer cancel()
+
+	stdout, output, err := runner.Run(ctx, scripts)
+	if err != nil {
+		return stdout, output, newSendError(ctx, output, err)
+	}
+
+	return stdout, output, nil
+}
+
+// ConfirmClearAll must be passed to ClearMessages, to show the caller means to delete everything.
+const ConfirmClearAll = "delete every conversation"
+
+// ErrNotConfirmed is returned by ClearMessages when it is not passed ConfirmClearAll.
+var ErrNotConfirmed = fmt.Errorf("clearing every conversation was not confirmed")
+
+// ClearMessages deletes all conversations in MESSAGES.APP. This can not be undone.
+// Pass ConfirmClearAll as confirm, or nothing is deleted and ErrNotConfirmed is returned.
 // Use this only if Messages is behaving poorly. Or, never use it at all.
-// This probably doesn't do anything you want to do.
-func (m *Messages) ClearMessages() error {
+// This probably doesn't do anything you want to do. See ClearConversation.
+func (m *Messages) ClearMessages(confirm string) error {
+	if confirm != ConfirmClearAll {
+		return ErrNotConfirmed
+	}
+
 	arg := `tell application "Messages"
 	activate
 	try
@@ -111,56 +455,375 @@ end tell
 		return err[0]
 	}
 
-	time.Sleep(sleepTime)
+	m.Clock.Sleep(m.SendDelay)
 
 	return nil
 }
 
+// clearConversations deletes the ClearChats conversations, or every conversation if ClearChats is empty.
+func (m *Messages) clearConversations() {
+	if len(m.ClearChats) == 0 {
+		m.DebugLog.Print("Clearing Messages.app Conversations")
+		m.checkErr(m.ClearMessages(ConfirmClearAll), ErrorSend, "clearing messages")
+
+		return
+	}
+
+	for _, chatGUID := range m.ClearChats {
+		m.DebugLog.Print("Clearing Messages.app Conversation: ", chatGUID)
+		m.checkErr(m.ClearConversation(chatGUID), ErrorSend, "clearing conversation "+chatGUID)
+	}
+}
+
 // processOutgoingMessages keeps an eye out for outgoing messages; then processes them.
-func (m *Messages) processOutgoingMessages() {
-	clearTicker := time.NewTicker(clearTime)
+// outChan is the channel made by the Start() that started this routine.
+func (m *Messages) processOutgoingMessages(outChan <-chan Outgoing) {
+	clearTicker := m.Clock.NewTicker(m.ClearInterval)
 	defer clearTicker.Stop()
 
 	newMsg := true
 
 	for {
 		select {
-		case msg, ok := <-m.outChan:
+		case msg, ok := <-outChan:
 			if !ok {
+				m.sendQueued(outChan) // anything Cancel moved into the queue.
 				return
 			}
 
 			newMsg = true
-			response := m.sendiMessage(msg)
 
-			if msg.Call != nil {
-				go msg.Call(response)
-			}
-		case <-clearTicker.C:
+			m.queue.push(msg)
+			m.sendQueued(outChan)
+		case <-m.queue.ready: // Cancel moved messages into the queue.
+			newMsg = true
+
+			m.sendQueued(outChan)
+		case <-clearTicker.Chan():
 			if m.ClearMsgs && newMsg {
 				newMsg = false
 
-				m.DebugLog.Print("Clearing Messages.app Conversations")
-				m.checkErr(m.ClearMessages(), "clearing messages")
+				m.clearConversations()
 			}
 		}
 	}
 }
 
+// finishSend reports a failed send, and runs the message's callback.
+func (m *Messages) finishSend(msg Outgoing, response *Response) {
+	if !response.Sent {
+		atomic.AddInt64(&m.stats.sendErrors, 1)
+		m.checkErr(response.Err(), ErrorSend, "sending message "+msg.ID)
+	} else {
+		atomic.AddInt64(&m.stats.sent, 1)
+
+		if !msg.File {
+			m.recent.add(msg.Text)
+		}
+	}
+
+	m.stats.observeSend(response.Elapsed)
+
+	if msg.Call != nil {
+		go msg.Call(response)
+	}
+
+	if msg.Status != nil && response.Sent {
+		go m.trackStatus(msg, response.after)
+	}
+}
+
 // sendiMessage runs the applesripts to send a message and close the iMessage windows.
 func (m *Messages) sendiMessage(msg Outgoing) *Response {
-	arg := []string{`tell application "Messages" to send "` + msg.Text + `" to buddy "` + msg.To +
-		`" of (1st service whose service type = iMessage)`}
+	if err := msg.checkService(); err != nil {
+		return msg.response(err)
+	}
+
+	if reaction, ok := msg.reaction(); ok {
+		return m.sendReaction(msg, reaction)
+	}
 
-	if _, err := os.Stat(msg.Text); err == nil && msg.File {
-		arg = []string{`tell application "Messages" to send (POSIX file ("` + msg.Text + `")) to buddy "` + msg.To +
-			`" of (1st service whose service type = iMessage)`}
+	chatGUID := msg.recipient()
+	if msg.drivesUI() {
+		var err error
+		if chatGUID, err = m.chatGUID(chatGUID, msg.service()); err != nil {
+			return msg.response(err)
+		}
+	}
+
+	if err := m.checkReplyTo(msg, chatGUID); err != nil {
+		return msg.response(err)
+	}
+
+	arg, errs := msg.scripts(chatGUID)
+	if errs != nil {
+		return msg.response(errs...)
 	}
 
 	arg = append(arg, `tell application "Messages" to close every window`)
-	sent, errs := m.RunAppleScript(arg)
+
+	after := m.statusAfter(msg)
+	start := m.Clock.Now()
+	_, output, sent, errs := m.runAppleScript(arg, msg.retries(m.Retries))
+	elapsed := m.since(start)
 	// Messages can go out so quickly we need to sleep a bit to avoid sending duplicates.
-	time.Sleep(sleepTime)
+	m.Clock.Sleep(m.sendDelay())
+
+	response := msg.response(errs...)
+	response.Sent, response.Elapsed, response.Output, response.after = sent, elapsed, output, after
+
+	if sent && m.VerifySends {
+		response.Confirmed = m.confirmSent(msg, after)
+	}
+
+	return response
+}
+
+// reaction returns the tapback to send instead of the text, if the message has one.
+func (msg *Outgoing) reaction() (ReactionType, bool) {
+	if msg.ReactTo == 0 || msg.File {
+		return 0, false
+	}
+
+	return reactionShortcut(msg.Text)
+}
+
+// response returns a Response for the message, with the provided errors. Sent is false.
+func (msg *Outgoing) response(errs ...error) *Response {
+	return &Response{ID: msg.ID, To: msg.To, Text: msg.Text, Errs: errs, Meta: msg.Meta}
+}
+
+// retries returns the number of send attempts for this message.
+func (msg *Outgoing) retries(defaultRetries int) int {
+	switch {
+	case msg.Retries <= 0:
+		return defaultRetries
+	case msg.Retries > maxRetries:
+		return maxRetries
+	default:
+		return msg.Retries
+	}
+}
+
+// scripts returns the AppleScripts that send the message. This is the send script, or the
+// effect or reply script if Effect or ReplyTo is set, after the typing indicator script if
+// ShowTyping is set. The scripts that drive the user interface open the chat with chatGUID.
+func (msg *Outgoing) scripts(chatGUID string) ([]string, []error) {
+	var arg []string
+
+	if msg.ShowTyping {
+		typing, err := typingScript(chatGUID)
+		if msg.IsGroup && err == nil {
+			err = fmt.Errorf("%w: %s", ErrUnsupportedChat, msg.To)
+		}
+
+		if err != nil {
+			return nil, []error{err}
+		}
+
+		arg = append(typing, clearTypingScript()...)
+	}
+
+	if msg.replying() {
+		reply, err := msg.replyScript(chatGUID)
+		if err != nil {
+			return nil, []error{err}
+		}
+
+		return append(arg, reply...), nil
+	}
+
+	if msg.Effect != "" {
+		effect, err := msg.effectScript(chatGUID)
+		if err != nil {
+			return nil, []error{err}
+		}
+
+		return append(arg, effect...), nil
+	}
+
+	script, errs := msg.sendScript()
+
+	return append(arg, script), errs
+}
+
+// sendScript returns the AppleScript statements that send the message, one per line.
+// File paths may start with ~/ and may contain spaces, quotes and other special characters.
+// Returns an error for each file that does not exist or is not a regular file, or
+// ErrInvalidService if the message can not be sent on its Service.
+func (msg *Outgoing) sendScript() (string, []error) {
+	var (
+		lines []string
+		errs  []error
+	)
+
+	if err := msg.checkService(); err != nil {
+		return "", []error{err}
+	}
+
+	files := msg.Files
+	if msg.File {
+		files = append([]string{msg.Text}, files...)
+	} else if len(files) == 0 {
+		return msg.textScript(), nil
+	}
+
+	for _, file := range files {
+		line, err := msg.fileScript(file)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	if errs != nil {
+		return "", errs // nothing is sent if any file is missing.
+	}
+
+	if !msg.File && strings.TrimSpace(msg.body()) != "" {
+		lines = append(lines, msg.textScript())
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// textScript returns the AppleScript statement that sends Text as a message.
+func (msg *Outgoing) textScript() string {
+	return `tell application "Messages" to send "` + escapeAppleScript(msg.body()) + `" to ` + msg.target()
+}
+
+// body returns the text to send: Text, after the Subject line if there is one.
+func (msg *Outgoing) body() string {
+	if msg.Subject == "" {
+		return msg.Text
+	}
+
+	return msg.Subject + "\n" + msg.Text
+}
+
+// fileScript returns the AppleScript statement that sends one file.
+func (msg *Outgoing) fileScript(file string) (string, error) {
+	path := expandHome(file)
+
+	if info, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("attachment: %w", err)
+	} else if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%w: %s", ErrInvalidFile, path)
+	}
+
+	return `tell application "Messages" to send (POSIX file ("` + escapeAppleScript(path) +
+		`")) to ` + msg.target(), nil
+}
+
+// target returns the AppleScript object specifier the message is sent to.
+// This is a chat for ChatGUID, a group chat for chat GUIDs and group names, a participant of the iMessage
+// account for email addresses (Apple IDs), otherwise a buddy of the message's Service.
+func (msg *Outgoing) target() string {
+	switch {
+	case msg.ChatGUID != "":
+		return `chat id "` + escapeAppleScript(msg.ChatGUID) + `"`
+	case isChatGUID(msg.To):
+		return `chat id "` + escapeAppleScript(msg.To) + `"`
+	case msg.IsGroup:
+		return `(1st chat whose name = "` + escapeAppleScript(msg.To) + `")`
+	case isEmail(msg.To):
+		// Apple ID emails do not always resolve as a buddy of the iMessage service.
+		return `participant "` + escapeAppleScript(msg.To) + `" of (1st account whose service type = iMessage)`
+	default:
+		return `buddy "` + escapeAppleScript(msg.To) + `" of (1st service whose service type = ` + msg.service() + `)`
+	}
+}
+
+// service returns the AppleScript service type the message is sent with: SMS or iMessage.
+func (msg *Outgoing) service() string {
+	if strings.EqualFold(msg.Service, ServiceSMS) {
+		return ServiceSMS
+	}
+
+	return ServiceIMessage
+}
+
+// checkService returns ErrInvalidService if Service is unknown, or SMS to an email address.
+// SMS messages can not show typing, or have an effect, a threaded reply or a tapback.
+func (msg *Outgoing) checkService() error {
+	if msg.Service != "" && !strings.EqualFold(msg.Service, ServiceIMessage) &&
+		!strings.EqualFold(msg.Service, ServiceSMS) {
+		return fmt.Errorf("%w: %q, use %s or %s", ErrInvalidService, msg.Service, ServiceIMessage, ServiceSMS)
+	}
+
+	// Chats keep their own service.
+	if msg.service() != ServiceSMS || msg.ChatGUID != "" || msg.IsGroup || isChatGUID(msg.To) {
+		return nil
+	}
+
+	if isEmail(msg.To) {
+		return fmt.Errorf("%w: %s needs a phone number, not %s", ErrInvalidService, ServiceSMS, msg.To)
+	}
+
+	if msg.drivesUI() {
+		return fmt.Errorf("%w: %s does not support ShowTyping, Effect, ReplyTo or ReactTo", ErrInvalidService, ServiceSMS)
+	}
+
+	return nil
+}
+
+// recipient returns the chat or handle the message is sent to: ChatGUID, if set, or To.
+func (msg *Outgoing) recipient() string {
+	if msg.ChatGUID != "" {
+		return msg.ChatGUID
+	}
+
+	return msg.To
+}
+
+// isChatGUID returns true if the string looks like a chat GUID: service;style;identifier.
+// The style is + for group chats and - for one-on-one chats.
+func isChatGUID(to string) bool {
+	return strings.Contains(to, ";+;") || strings.Contains(to, ";-;")
+}
+
+// isEmail returns true if the handle is an email address rather than a phone number.
+func isEmail(handle string) bool {
+	return strings.Contains(handle, "@")
+}
+
+// escapeAppleScript makes a string safe to use inside a double-quoted AppleScript string literal.
+// Quotes and backslashes are escaped, and control characters are converted to their
+// escape sequences, or concatenated as `character id` expressions if they have none.
+func escapeAppleScript(str string) string {
+	var out strings.Builder
+
+	for _, char := range str {
+		switch char {
+		case '"':
+			out.WriteString(`\"`)
+		case '\\':
+			out.WriteString(`\\`)
+		case '\n':
+			out.WriteString(`\n`)
+		case '\r':
+			out.WriteString(`\r`)
+		case '\t':
+			out.WriteString(`\t`)
+		default:
+			if unicode.IsControl(char) {
+				out.WriteString(`" & (character id ` + strconv.Itoa(int(char)) + `) & "`)
+			} else {
+				out.WriteRune(char)
+			}
+		}
+	}
+
+	return out.String()
+}
+
+// sendDelay returns how long to wait after sending a message: SendDelay plus up to SendJitter.
+func (m *Messages) sendDelay() time.Duration {
+	if m.SendJitter <= 0 {
+		return m.SendDelay
+	}
 
-	return &Response{ID: msg.ID, To: msg.To, Text: msg.Text, Errs: errs, Sent: sent}
+	return m.SendDelay + time.Duration(rand.Int63n(int64(m.SendJitter)+1)) //nolint:gosec
 }
@@ -0,0 +1,263 @@
+package imessage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// appleScriptString reads the double-quoted AppleScript string literal at the start of
+// script, and returns its value and the rest of the script after the closing quote.
+// `character id` concatenations are not decoded; they are returned as written.
+func appleScriptString(t *testing.T, script string) (string, string) {
+	t.Helper()
+
+	if !strings.HasPrefix(script, `"`) {
+		t.Fatalf("no string literal at %q", script)
+	}
+
+	var value strings.Builder
+
+	for i := 1; i < len(script); i++ {
+		switch char := script[i]; char {
+		case '"':
+			return value.String(), script[i+1:]
+		case '\\':
+			i++
+
+			switch script[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			case 't':
+				value.WriteByte('\t')
+			default:
+				value.WriteByte(script[i])
+			}
+		default:
+			value.WriteByte(char)
+		}
+	}
+
+	t.Fatalf("unterminated string literal: %q", script)
+
+	return "", ""
+}
+
+func TestEscapeAppleScript(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in, want string
+	}{
+		{`plain text`, `plain text`},
+		{`he said "hi"`, `he said \"hi\"`},
+		{`back\slash`, `back\\slash`},
+		{"two\nlines\r\ttab", `two\nlines\r\ttab`},
+		{"bell\a", `bell" & (character id 7) & "`},
+		{`emoji 😀 ok`, `emoji 😀 ok`},
+		{`\"`, `\\\"`},
+	}
+
+	for _, test := range tests {
+		if got := escapeAppleScript(test.in); got != test.want {
+			t.Errorf("escapeAppleScript(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+// Text from a message must stay inside the string literal it is sent in.
+func TestSendScriptInert(t *testing.T) {
+	t.Parallel()
+
+	tests := []string{
+		"he said \"hi\"\n; do shell script \"rm -rf ~\"",
+		`" & (do shell script "rm -rf ~") & "`,
+		`\" to buddy "x"`,
+		"trailing backslash \\",
+		"carriage\rreturn\ttab",
+	}
+
+	for _, text := range tests {
+		msg := Outgoing{To: "+15551234567", Text: text}
+
+		script, errs := msg.sendScript()
+		if errs != nil {
+			t.Fatalf("sendScript(%q): %v", text, errs)
+		}
+
+		const prefix = `tell application "Messages" to send `
+		if !strings.HasPrefix(script, prefix) {
+			t.Fatalf("sendScript(%q) = %q, want prefix %q", text, script, prefix)
+		}
+
+		value, rest := appleScriptString(t, strings.TrimPrefix(script, prefix))
+		if value != text {
+			t.Errorf("sendScript(%q) sends %q", text, value)
+		}
+
+		if want := " to " + msg.target(); rest != want {
+			t.Errorf("sendScript(%q) ends with %q, want %q", text, rest, want)
+		}
+
+		if strings.Contains(script, "\n") {
+			t.Errorf("sendScript(%q) has more than one line: %q", text, script)
+		}
+	}
+}
+
+func TestFileScript(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	names := []string{`My Photos/img "final".png`, `back\slash.png`, "new\nline.png", `it's.png`}
+
+	for _, name := range names {
+		path := filepath.Join(home, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte("png"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		msg := Outgoing{To: "+15551234567", Text: "~/" + name, File: true}
+
+		script, err := msg.fileScript(msg.Text)
+		if err != nil {
+			t.Fatalf("fileScript(%q): %v", msg.Text, err)
+		}
+
+		const prefix = `tell application "Messages" to send (POSIX file (`
+		if !strings.HasPrefix(script, prefix) {
+			t.Fatalf("fileScript(%q) = %q, want prefix %q", msg.Text, script, prefix)
+		}
+
+		value, rest := appleScriptString(t, strings.TrimPrefix(script, prefix))
+		if value != path {
+			t.Errorf("fileScript(%q) sends %q, want %q", msg.Text, value, path)
+		}
+
+		if want := ")) to " + msg.target(); rest != want {
+			t.Errorf("fileScript(%q) ends with %q, want %q", msg.Text, rest, want)
+		}
+	}
+}
+
+func TestSendScriptMissingFile(t *testing.T) {
+	t.Parallel()
+
+	missing := filepath.Join(t.TempDir(), "missing.png")
+
+	tests := []Outgoing{
+		{To: "+15551234567", Text: missing, File: true},
+		{To: "+15551234567", Text: "caption", Files: []string{missing}},
+		{To: "+15551234567", Text: t.TempDir(), File: true}, // a directory.
+	}
+
+	for _, msg := range tests {
+		script, errs := msg.sendScript()
+		if len(errs) == 0 {
+			t.Errorf("sendScript(%q, %q) returned no error", msg.Text, msg.Files)
+		}
+
+		if strings.Contains(script, "send") {
+			t.Errorf("sendScript(%q, %q) = %q, want no send line", msg.Text, msg.Files, script)
+		}
+	}
+}
+
+func TestTarget(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		msg  Outgoing
+		want string
+	}{
+		{Outgoing{To: "+15551234567"}, `buddy "+15551234567" of (1st service whose service type = iMessage)`},
+		{Outgoing{To: "5551234567"}, `buddy "5551234567" of (1st service whose service type = iMessage)`},
+		{Outgoing{To: "+15551234567", Service: "sms"}, `buddy "+15551234567" of (1st service whose service type = SMS)`},
+		{Outgoing{To: "user@example.com"}, `participant "user@example.com" of (1st account whose service type = iMessage)`},
+		{Outgoing{To: "User.Name+tag@icloud.com"},
+			`participant "User.Name+tag@icloud.com" of (1st account whose service type = iMessage)`},
+		{Outgoing{To: "iMessage;-;+15551234567"}, `chat id "iMessage;-;+15551234567"`},
+		{Outgoing{To: "iMessage;+;chat123", IsGroup: true}, `chat id "iMessage;+;chat123"`},
+		{Outgoing{To: "Family", IsGroup: true}, `(1st chat whose name = "Family")`},
+		{Outgoing{To: "user@example.com", ChatGUID: "SMS;-;+15551234567"}, `chat id "SMS;-;+15551234567"`},
+	}
+
+	for _, test := range tests {
+		if got := test.msg.target(); got != test.want {
+			t.Errorf("target(%q) = %q, want %q", test.msg.To, got, test.want)
+		}
+	}
+}
+
+// scriptsRunner is a ScriptRunner that records every script it runs.
+type scriptsRunner struct {
+	sync.Mutex
+	runs [][]string
+}
+
+func (r *scriptsRunner) Run(_ context.Context, scripts []string) (string, string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.runs = append(r.runs, scripts)
+
+	return "", "", nil
+}
+
+// Service is checked before any script runs, for every kind of message.
+func TestSendiMessageService(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		msg   Outgoing
+		valid bool
+	}{
+		"unknown typing":   {msg: Outgoing{To: "+15551234567", Text: "hi", Service: "Fax", ShowTyping: true}},
+		"unknown effect":   {msg: Outgoing{To: "+15551234567", Text: "hi", Service: "Fax", Effect: "lasers"}},
+		"unknown reaction": {msg: Outgoing{To: "+15551234567", Text: "!like", Service: "Fax", ReactTo: 1}},
+		"sms typing":       {msg: Outgoing{To: "+15551234567", Text: "hi", Service: "sms", ShowTyping: true}},
+		"sms effect":       {msg: Outgoing{To: "+15551234567", Text: "hi", Service: "SMS", Effect: "lasers"}},
+		"sms reply":        {msg: Outgoing{To: "+15551234567", Text: "hi", Service: "SMS", ReplyTo: "guid"}},
+		"sms reaction":     {msg: Outgoing{To: "+15551234567", Text: "!like", Service: "SMS", ReactTo: 1}},
+		"sms email":        {msg: Outgoing{To: "bob@example.com", Text: "hi", Service: "SMS"}},
+		"sms":              {msg: Outgoing{To: "+15551234567", Text: "hi", Service: "SMS"}, valid: true},
+		"sms chat typing": {
+			msg:   Outgoing{ChatGUID: "SMS;-;+15551234567", Text: "hi", Service: "SMS", ShowTyping: true},
+			valid: true,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			m := newTestMessages(t, &Config{SendDelay: time.Millisecond})
+			runner := &scriptsRunner{}
+			m.DryRun, m.Runner = false, runner
+
+			resp := m.sendiMessage(test.msg)
+
+			switch invalid := len(resp.Errs) == 1 && errors.Is(resp.Errs[0], ErrInvalidService); {
+			case test.valid && (invalid || !resp.Sent):
+				t.Errorf("message was not sent: %v", resp.Errs)
+			case !test.valid && !invalid:
+				t.Errorf("got errors %v, expected ErrInvalidService", resp.Errs)
+			case !test.valid && len(runner.runs) > 0:
+				t.Errorf("invalid message ran scripts: %q", runner.runs)
+			}
+		})
+	}
+}
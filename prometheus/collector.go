@@ -0,0 +1,83 @@
+// Package prometheus exposes the imessage library's message counters and send latency
+// as Prometheus metrics. It is its own module, so the Prometheus client library is only
+// a dependency of programs that use it.
+package prometheus
+
+import (
+	"github.com/neild0/imessage"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Namespace is the prefix of every metric name.
+const Namespace = "imessage"
+
+// Collector exposes Messages.Stats() as Prometheus metrics.
+type Collector struct {
+	msgs        *imessage.Messages
+	received    *prom.Desc
+	sent        *prom.Desc
+	sendErrors  *prom.Desc
+	retries     *prom.Desc
+	checks      *prom.Desc
+	checkTime   *prom.Desc
+	fileEvents  *prom.Desc
+	polls       *prom.Desc
+	dropped     *prom.Desc
+	sendLatency *prom.Desc
+}
+
+// NewCollector returns a Prometheus collector for the message counters and send latency.
+// Register it with a registry, like prometheus.MustRegister(collector).
+func NewCollector(msgs *imessage.Messages) *Collector {
+	desc := func(name, help string) *prom.Desc {
+		return prom.NewDesc(prom.BuildFQName(Namespace, "", name), help, nil, nil)
+	}
+
+	return &Collector{
+		msgs:        msgs,
+		received:    desc("received_total", "Incoming messages read from the database."),
+		sent:        desc("sent_total", "Outgoing messages sent successfully."),
+		sendErrors:  desc("send_errors_total", "Outgoing messages that failed to send."),
+		retries:     desc("applescript_retries_total", "AppleScript attempts that were retries."),
+		checks:      desc("db_checks_total", "Times the database was checked for new messages."),
+		checkTime:   desc("db_check_seconds_total", "Total time spent checking the database."),
+		fileEvents:  desc("file_events_total", "File system write events that triggered a database check."),
+		polls:       desc("db_polls_total", "Database checks made by polling, after fsnotify failed."),
+		dropped:     desc("dropped_total", "Incoming messages dropped because a non-blocking channel was full."),
+		sendLatency: desc("send_duration_seconds", "Time spent running send AppleScripts."),
+	}
+}
+
+// Describe satisfies the prometheus.Collector interface.
+func (c *Collector) Describe(descs chan<- *prom.Desc) {
+	for _, desc := range []*prom.Desc{c.received, c.sent, c.sendErrors, c.retries,
+		c.checks, c.checkTime, c.fileEvents, c.polls, c.dropped, c.sendLatency} {
+		descs <- desc
+	}
+}
+
+// Collect satisfies the prometheus.Collector interface.
+func (c *Collector) Collect(metrics chan<- prom.Metric) {
+	stats := c.msgs.Stats()
+	counter := func(desc *prom.Desc, value float64) {
+		metrics <- prom.MustNewConstMetric(desc, prom.CounterValue, value)
+	}
+
+	counter(c.received, float64(stats.Received))
+	counter(c.sent, float64(stats.Sent))
+	counter(c.sendErrors, float64(stats.SendErrors))
+	counter(c.retries, float64(stats.Retries))
+	counter(c.checks, float64(stats.Checks))
+	counter(c.checkTime, stats.CheckTime.Seconds())
+	counter(c.fileEvents, float64(stats.FileEvents))
+	counter(c.polls, float64(stats.Polls))
+	counter(c.dropped, float64(stats.Dropped))
+
+	buckets := make(map[float64]uint64, len(stats.SendLatency))
+	for bucket, count := range stats.SendLatency {
+		buckets[bucket.Seconds()] = uint64(count)
+	}
+
+	metrics <- prom.MustNewConstHistogram(c.sendLatency,
+		uint64(stats.Sent+stats.SendErrors), stats.SendTime.Seconds(), buckets)
+}
@@ -0,0 +1,35 @@
+package prometheus_test
+
+import (
+	"testing"
+
+	"github.com/neild0/imessage"
+	"github.com/neild0/imessage/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// source is an imessage.Source with no messages, so no database is needed.
+type source chan imessage.Incoming
+
+func (s source) Start() error                       { return nil }
+func (s source) Messages() <-chan imessage.Incoming { return s }
+func (s source) Stop()                              { close(s) }
+
+func TestCollector(t *testing.T) {
+	t.Parallel()
+
+	msgs, err := imessage.Init(&imessage.Config{Source: make(source), DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collector := prometheus.NewCollector(msgs)
+
+	if problems, err := testutil.CollectAndLint(collector); err != nil || len(problems) > 0 {
+		t.Errorf("lint problems: %v, error: %v", problems, err)
+	}
+
+	if count := testutil.CollectAndCount(collector); count != 10 { //nolint:gomnd
+		t.Errorf("collected %d metrics, expected 10", count)
+	}
+}
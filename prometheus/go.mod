@@ -0,0 +1,10 @@
+module github.com/neild0/imessage/prometheus
+
+go 1.16
+
+require (
+	github.com/neild0/imessage v0.0.0-00010101000000-000000000000
+	github.com/prometheus/client_golang v1.12.2
+)
+
+replace github.com/neild0/imessage => ../
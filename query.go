@@ -0,0 +1,63 @@
+package imessage
+
+import (
+	"fmt"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// ErrInvalidQuery is returned by Query when the sql is not exactly one statement.
+var ErrInvalidQuery = fmt.Errorf("query must be exactly one sql statement")
+
+// Query runs your own sql statement against the iMessage database (SQLPath), using the same
+// read-only connection handling and busy retries as the rest of this library, so it never
+// contends with the message watcher. bind sets the statement's parameters, and may be nil.
+// scan is called for each result row; when it returns an error, the remaining rows are
+// skipped and that error is returned. If the database is busy, the statement is reset and
+// bind is called again before retrying, so reset anything scan collected in bind.
+// Do not keep the *sqlite.Stmt after the call returns.
+//
+//nolint:wrapcheck
+func (m *Messages) Query(sql string, bind func(*sqlite.Stmt), scan func(*sqlite.Stmt) error) error {
+	if strings.TrimSpace(sql) == "" {
+		return ErrInvalidQuery
+	}
+
+	dbase, err := m.getDB()
+	if err != nil {
+		return err
+	}
+
+	defer m.closeDB(dbase)
+
+	query, trailing, err := dbase.PrepareTransient(sql)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(sql[len(sql)-trailing:]) != "" {
+		_ = query.Finalize()
+		return ErrInvalidQuery
+	}
+
+	var scanErr error
+
+	err = m.stepRows(query, func(query *sqlite.Stmt) {
+		scanErr = nil
+
+		if bind != nil {
+			bind(query)
+		}
+	}, func(query *sqlite.Stmt) {
+		if scanErr == nil {
+			scanErr = scan(query)
+		}
+	})
+	if err != nil {
+		m.checkErr(err, ErrorDatabase, sql)
+		return err
+	}
+
+	return scanErr
+}
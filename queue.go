@@ -0,0 +1,260 @@
+package imessage
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// outQueue holds outgoing messages waiting to be sent, highest Priority first.
+// Messages with the same priority are sent in the order they were queued.
+// Messages are moved here from outChan right before sending, and by Cancel.
+type outQueue struct {
+	items []queued
+	seq   uint64
+	ready chan struct{} // receives a value when a message is pushed.
+	sync.Mutex
+}
+
+// newOutQueue returns an empty queue.
+func newOutQueue() *outQueue {
+	return &outQueue{ready: make(chan struct{}, 1)}
+}
+
+// queued is an outgoing message and the order it was queued in.
+type queued struct {
+	msg Outgoing
+	seq uint64
+}
+
+// push adds a message to the queue.
+func (q *outQueue) push(msg Outgoing) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.seq++
+	heap.Push(q, queued{msg: msg, seq: q.seq})
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// depth returns how many messages are in the queue.
+func (q *outQueue) depth() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.items)
+}
+
+// pop removes and returns the next message to send. Returns false if the queue is empty.
+func (q *outQueue) pop() (Outgoing, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.items) == 0 {
+		return Outgoing{}, false
+	}
+
+	return heap.Pop(q).(queued).msg, true //nolint:forcetypeassert
+}
+
+// popExcept removes and returns the next message to send that is not to one of the busy
+// recipients. Returns false if there is no such message.
+func (q *outQueue) popExcept(busy map[string]bool) (Outgoing, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	next := -1
+
+	for i, item := range q.items {
+		if !busy[item.msg.recipient()] && (next == -1 || q.Less(i, next)) {
+			next = i
+		}
+	}
+
+	if next == -1 {
+		return Outgoing{}, false
+	}
+
+	return heap.Remove(q, next).(queued).msg, true //nolint:forcetypeassert
+}
+
+// remove takes every message with the provided ID out of the queue and returns them.
+func (q *outQueue) remove(id string) []Outgoing {
+	q.Lock()
+	defer q.Unlock()
+
+	var (
+		removed []Outgoing
+		kept    = q.items[:0]
+	)
+
+	for _, item := range q.items {
+		if item.msg.ID == id {
+			removed = append(removed, item.msg)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+
+	q.items = kept
+	heap.Init(q)
+
+	return removed
+}
+
+// These methods satisfy heap.Interface, and are only called with the lock held.
+// Use push and pop instead of Push and Pop.
+
+func (q *outQueue) Len() int { return len(q.items) }
+
+func (q *outQueue) Less(i, j int) bool {
+	if q.items[i].msg.Priority != q.items[j].msg.Priority {
+		return q.items[i].msg.Priority > q.items[j].msg.Priority
+	}
+
+	return q.items[i].seq < q.items[j].seq
+}
+
+func (q *outQueue) Swap(i, j int) { q.items[i], q.items[j] = q.items[j], q.items[i] }
+
+func (q *outQueue) Push(item interface{}) { q.items = append(q.items, item.(queued)) } //nolint:forcetypeassert
+
+func (q *outQueue) Pop() interface{} {
+	item := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+
+	return item
+}
+
+// Cancel removes every queued message with the provided ID, so it is not sent.
+// Returns false if no message was removed; it may already be sending, or sent.
+// Canceled messages still have their Call function run, with ErrCanceled in Errs.
+func (m *Messages) Cancel(id string) bool {
+	m.outLock.RLock()
+	m.fillQueue(m.outChan)
+	m.outLock.RUnlock()
+
+	removed := m.queue.remove(id)
+	for _, msg := range removed {
+		if msg.Call != nil {
+			go msg.Call(msg.response(ErrCanceled))
+		}
+	}
+
+	return len(removed) > 0
+}
+
+// fillQueue moves every message waiting in the outgoing channel into the queue, without blocking.
+func (m *Messages) fillQueue(outChan <-chan Outgoing) {
+	for {
+		select {
+		case msg, ok := <-outChan:
+			if !ok {
+				return
+			}
+
+			m.queue.push(msg)
+		default:
+			return
+		}
+	}
+}
+
+// sendQueued sends messages from the queue, highest priority first, until it is empty.
+// Messages that arrive while sending are added to the queue before the next send.
+func (m *Messages) sendQueued(outChan <-chan Outgoing) {
+	if m.SendWorkers > 1 && m.BatchSize < 2 {
+		m.sendParallel(outChan)
+		return
+	}
+
+	for {
+		m.fillQueue(outChan)
+
+		msg, ok := m.queue.pop()
+		if !ok {
+			return
+		}
+
+		if m.BatchSize > 1 {
+			m.sendBatch(m.collectBatch(msg, outChan))
+		} else {
+			m.finishSend(msg, m.sendiMessage(msg))
+		}
+	}
+}
+
+// sendParallel sends messages from the queue to up to SendWorkers recipients at once, until the
+// queue is empty and every send finished. Each recipient gets one message at a time, so their
+// messages are sent in queue order. Messages that drive the Messages.app UI are sent alone:
+// they wait for the other workers to finish, and nothing else starts until they are sent.
+func (m *Messages) sendParallel(outChan <-chan Outgoing) {
+	var (
+		busy      = make(map[string]bool)
+		done      = make(chan string)
+		waiting   *Outgoing // UI message waiting for the other workers to finish.
+		exclusive bool      // A UI message is sending.
+	)
+
+	send := func(msg Outgoing) {
+		busy[msg.recipient()] = true
+
+		go func() {
+			m.finishSend(msg, m.sendiMessage(msg))
+			done <- msg.recipient()
+		}()
+	}
+
+	for {
+		m.fillQueue(outChan)
+
+		if waiting != nil && len(busy) == 0 {
+			exclusive = true
+			send(*waiting)
+			waiting = nil
+
+			continue
+		}
+
+		if waiting == nil && !exclusive && len(busy) < m.SendWorkers {
+			if msg, ok := m.queue.popExcept(busy); ok {
+				if msg.drivesUI() {
+					waiting = &msg
+				} else {
+					send(msg)
+				}
+
+				continue
+			}
+		}
+
+		if len(busy) == 0 {
+			return
+		}
+
+		select {
+		case to := <-done:
+			delete(busy, to)
+			exclusive = exclusive && len(busy) > 0
+		case msg, ok := <-outChan:
+			if !ok {
+				outChan = nil // closed; finish sending what's queued.
+				continue
+			}
+
+			m.queue.push(msg)
+		case <-m.queue.ready:
+		}
+	}
+}
+
+// drivesUI returns true if sending the message types into, or clicks on, the Messages.app
+// window. Another send closing the windows would break it, so these are never sent in parallel.
+func (msg *Outgoing) drivesUI() bool {
+	_, reacting := msg.reaction()
+
+	return msg.ShowTyping || msg.Effect != "" || msg.replying() || reacting
+}
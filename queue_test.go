@@ -0,0 +1,75 @@
+package imessage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// uiRunner is a ScriptRunner that fails the test if a script that drives the
+// Messages.app UI runs at the same time as any other script.
+type uiRunner struct {
+	t       *testing.T
+	lock    sync.Mutex
+	running int
+	ui      bool
+	overlap int // How many times two scripts ran at once.
+}
+
+func (r *uiRunner) Run(_ context.Context, scripts []string) (string, string, error) {
+	ui := strings.Contains(strings.Join(scripts, "\n"), "System Events")
+
+	r.lock.Lock()
+	if r.ui || (ui && r.running > 0) {
+		r.t.Errorf("script ran with a UI script: %q", scripts)
+	} else if r.running > 0 {
+		r.overlap++
+	}
+
+	r.running++
+	r.ui = r.ui || ui
+	r.lock.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	r.lock.Lock()
+	r.running--
+	r.ui = r.ui && !ui
+	r.lock.Unlock()
+
+	return "", "", nil
+}
+
+func TestSendParallelUI(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{SendWorkers: 4, SendDelay: time.Millisecond})
+	runner := &uiRunner{t: t}
+	m.DryRun, m.Runner = false, runner
+
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		m.Send(Outgoing{
+			To:         fmt.Sprintf("+1555000000%d", i%8),
+			Text:       fmt.Sprint("hi ", i),
+			ShowTyping: i%5 == 0,
+			Call:       func(*Response) { wg.Done() },
+		})
+	}
+
+	wg.Wait()
+
+	if runner.overlap == 0 {
+		t.Error("plain messages were never sent in parallel")
+	}
+}
@@ -0,0 +1,213 @@
+package imessage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReactionType is a tapback reaction. The values match associated_message_type in the iMessage database.
+type ReactionType int
+
+// These are the available tapback reactions.
+const (
+	ReactionLove ReactionType = iota + 2000
+	ReactionLike
+	ReactionDislike
+	ReactionLaugh
+	ReactionEmphasize
+	ReactionQuestion
+)
+
+// reactionRemoved is added to a ReactionType in the database when a tapback is removed.
+const reactionRemoved = 1000
+
+// Reaction is a tapback on an incoming message. Incoming messages that are reactions have
+// a non-nil Reaction. Their Text is a description provided by the sender, like Loved "hi".
+type Reaction struct {
+	Type    ReactionType `json:"type"`    // Type is the kind of tapback.
+	Removed bool         `json:"removed"` // Removed is true if the sender took this reaction back.
+	Target  string       `json:"target"`  // Target is the GUID of the message that was reacted to.
+}
+
+// Errors returned by SendReaction.
+var (
+	ErrInvalidReaction = fmt.Errorf("invalid reaction type")
+	ErrReactionTarget  = fmt.Errorf("reactions may only target the most recent incoming message in a chat")
+	ErrUnsupportedChat = fmt.Errorf("group chats are not supported for this action")
+)
+
+// reactionDelay is how long to wait for Messages.app to open a conversation and the tapback menu.
+const reactionDelay = time.Second
+
+// String returns the name of the reaction.
+func (r ReactionType) String() string {
+	switch r {
+	case ReactionLove:
+		return "love"
+	case ReactionLike:
+		return "like"
+	case ReactionDislike:
+		return "dislike"
+	case ReactionLaugh:
+		return "laugh"
+	case ReactionEmphasize:
+		return "emphasize"
+	case ReactionQuestion:
+		return "question"
+	default:
+		return "unknown"
+	}
+}
+
+// SendReaction applies a tapback reaction to a message. This is a best-effort feature that drives
+// the Messages.app user interface with System Events, so it requires Accessibility permission.
+// The tapback menu only targets the most recent message, so targetRowID must be the latest incoming
+// message in the chat, otherwise ErrReactionTarget is returned. Only one-on-one chats are supported.
+// Use the ChatGUID and RowID from an Incoming message, or a handle with a chat in the database.
+func (m *Messages) SendReaction(chatGUID string, targetRowID int64, reaction ReactionType) error {
+	if reaction < ReactionLove || reaction > ReactionQuestion {
+		return fmt.Errorf("%w: %d", ErrInvalidReaction, reaction)
+	}
+
+	chatGUID, err := m.chatGUID(chatGUID, ServiceIMessage)
+	if err != nil {
+		return err
+	}
+
+	openChat, err := openChatScript(chatGUID)
+	if err != nil {
+		return err
+	}
+
+	latest, err := m.getLatestChatID(chatGUID)
+	if err != nil {
+		return err
+	} else if latest != targetRowID {
+		return fmt.Errorf("%w: target %d, latest %d", ErrReactionTarget, targetRowID, latest)
+	}
+
+	delay := strconv.FormatFloat(reactionDelay.Seconds(), 'f', -1, 64)
+	arg := append(openChat,
+		`delay `+delay,
+		`tell application "System Events" to tell process "Messages" to keystroke "t" using command down`,
+		`delay `+delay,
+		`tell application "System Events" to tell process "Messages" to keystroke "`+
+			strconv.Itoa(int(reaction-ReactionLove)+1)+`"`,
+		`delay `+delay,
+		`tell application "Messages" to close every window`,
+	)
+
+	if sent, errs := m.RunAppleScript(arg); !sent && len(errs) > 0 {
+		return errs[0]
+	}
+
+	m.Clock.Sleep(m.sendDelay())
+
+	return nil
+}
+
+// reactionShortcut returns the reaction for text like !love or !like, the names from
+// ReactionType.String with a ! in front. !heart and !haha also work. Case is ignored.
+func reactionShortcut(text string) (ReactionType, bool) {
+	name := strings.ToLower(strings.TrimSpace(text))
+	if !strings.HasPrefix(name, "!") {
+		return 0, false
+	}
+
+	switch name = name[1:]; name {
+	case "heart":
+		return ReactionLove, true
+	case "haha":
+		return ReactionLaugh, true
+	}
+
+	for reaction := ReactionLove; reaction <= ReactionQuestion; reaction++ {
+		if reaction.String() == name {
+			return reaction, true
+		}
+	}
+
+	return 0, false
+}
+
+// sendReaction sends the tapback for an outgoing message with ReactTo and a reaction shortcut.
+func (m *Messages) sendReaction(msg Outgoing, reaction ReactionType) *Response {
+	response := msg.response()
+	start := m.Clock.Now()
+
+	chatGUID, err := m.chatGUID(msg.recipient(), msg.service())
+	if err == nil {
+		err = m.SendReaction(chatGUID, msg.ReactTo, reaction)
+	}
+
+	if err != nil {
+		response.Errs = []error{err}
+	} else {
+		response.Sent = true
+	}
+
+	response.Elapsed = m.since(start)
+
+	return response
+}
+
+// getLatestChatID returns the row id of the most recent incoming message in a chat.
+//
+//nolint:wrapcheck
+func (m *Messages) getLatestChatID(chatGUID string) (int64, error) {
+	sql := `SELECT MAX(message.ROWID) AS id FROM message ` +
+		`INNER JOIN chat_message_join ON chat_message_join.message_id = message.ROWID ` +
+		`INNER JOIN chat ON chat.ROWID = chat_message_join.chat_id ` +
+		`WHERE message.is_from_me=0 AND chat.guid = $guid`
+
+	dbase, err := m.getDB()
+	if err != nil {
+		return 0, err
+	}
+
+	defer m.closeDB(dbase)
+
+	query, _, err := dbase.PrepareTransient(sql)
+	if err != nil {
+		return 0, err
+	}
+
+	query.SetText("$guid", chatGUID)
+
+	if hasrow, err := query.Step(); err != nil {
+		m.checkErr(err, ErrorDatabase, sql)
+		return 0, err
+	} else if !hasrow {
+		_ = query.Finalize()
+		return 0, ErrNoRows
+	}
+
+	id := query.GetInt64("id")
+
+	return id, query.Finalize()
+}
+
+// parseReaction turns associated_message columns into a Reaction.
+// Returns nil if the message is not a tapback.
+func parseReaction(msgType int64, target string) *Reaction {
+	reaction := &Reaction{Type: ReactionType(msgType)}
+	if reaction.Type >= ReactionLove+reactionRemoved {
+		reaction.Type -= reactionRemoved
+		reaction.Removed = true
+	}
+
+	if reaction.Type < ReactionLove || reaction.Type > ReactionQuestion {
+		return nil
+	}
+
+	// The target guid looks like p:0/GUID or bp:GUID.
+	if i := strings.LastIndex(target, "/"); i >= 0 {
+		reaction.Target = target[i+1:]
+	} else {
+		reaction.Target = strings.TrimPrefix(target, "bp:")
+	}
+
+	return reaction
+}
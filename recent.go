@@ -0,0 +1,54 @@
+package imessage
+
+import (
+	"strings"
+	"sync"
+)
+
+// recentSent remembers the text of the last few sent messages in a ring buffer.
+// Incoming messages with the same text are suppressed, to stop reply loops.
+type recentSent struct {
+	texts []string
+	next  int
+	sync.Mutex
+}
+
+// newRecentSent returns a buffer for size texts. A nil buffer (size < 1) remembers nothing.
+func newRecentSent(size int) *recentSent {
+	if size < 1 {
+		return nil
+	}
+
+	return &recentSent{texts: make([]string, size)}
+}
+
+// add remembers a sent text, replacing the oldest one if the buffer is full.
+func (r *recentSent) add(text string) {
+	if r == nil || text == "" {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.texts[r.next] = strings.TrimSpace(text)
+	r.next = (r.next + 1) % len(r.texts)
+}
+
+// has returns true if the text was recently sent.
+func (r *recentSent) has(text string) bool {
+	if r == nil || text == "" {
+		return false
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	for _, sent := range r.texts {
+		if sent == text {
+			return true
+		}
+	}
+
+	return false
+}
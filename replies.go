@@ -0,0 +1,96 @@
+package imessage
+
+import (
+	"fmt"
+
+	"crawshaw.io/sqlite"
+)
+
+// ErrReplyTarget is returned when an Outgoing message's ReplyTo is not the most recent
+// incoming message in its chat. Messages.app can only reply to that one from the keyboard.
+var ErrReplyTarget = fmt.Errorf("replies may only target the most recent incoming message in a chat")
+
+// replying returns true if the message is a threaded reply. Files are never sent as replies.
+func (msg *Outgoing) replying() bool {
+	return msg.ReplyTo != "" && !msg.File
+}
+
+// checkReplyTo returns ErrReplyTarget if the message is a threaded reply to anything but the
+// most recent incoming message in its chat, chatGUID.
+func (m *Messages) checkReplyTo(msg Outgoing, chatGUID string) error {
+	if !msg.replying() {
+		return nil
+	}
+
+	latest, err := m.getLatestChatGUID(chatGUID)
+	if err != nil {
+		return err
+	} else if latest != msg.ReplyTo {
+		return fmt.Errorf("%w: target %s, latest %s", ErrReplyTarget, msg.ReplyTo, latest)
+	}
+
+	return nil
+}
+
+// replyScript returns the AppleScript that sends a text message as a threaded reply.
+// AppleScript cannot send replies, so this drives the Messages.app user interface:
+// it opens the conversation, replies to the last message with command-R, pastes the
+// text and presses return, then restores the clipboard. This needs Accessibility access, and only works for
+// one-on-one chats.
+func (msg *Outgoing) replyScript(chatGUID string) ([]string, error) {
+	if len(msg.Files) > 0 || msg.IsGroup || msg.Effect != "" {
+		return nil, fmt.Errorf("%w: replies only work with text in one-on-one chats", ErrUnsupportedChat)
+	}
+
+	openChat, err := openChatScript(chatGUID)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(openChat, `delay 1`, // wait for the conversation window to open.
+		`tell application "System Events" to tell process "Messages"
+	keystroke "r" using command down
+	delay 0.5
+	`+pasteScript(msg.body())+`
+	delay 0.5
+	key code 36
+	delay 0.5
+	set the clipboard to savedClipboard
+end tell`), nil
+}
+
+// getLatestChatGUID returns the GUID of the most recent incoming message in a chat.
+// Returns an empty string if the chat has no incoming messages.
+//
+//nolint:wrapcheck
+func (m *Messages) getLatestChatGUID(chatGUID string) (string, error) {
+	sql := `SELECT message.guid AS guid FROM message ` +
+		`INNER JOIN chat_message_join ON chat_message_join.message_id = message.ROWID ` +
+		`INNER JOIN chat ON chat.ROWID = chat_message_join.chat_id ` +
+		`WHERE message.is_from_me=0 AND chat.guid = $guid ORDER BY message.ROWID DESC LIMIT 1`
+
+	dbase, err := m.getDB()
+	if err != nil {
+		return "", err
+	}
+
+	defer m.closeDB(dbase)
+
+	query, _, err := dbase.PrepareTransient(sql)
+	if err != nil {
+		return "", err
+	}
+
+	latest := ""
+
+	err = m.stepRows(query, func(query *sqlite.Stmt) {
+		query.SetText("$guid", chatGUID)
+	}, func(query *sqlite.Stmt) {
+		latest = query.GetText("guid")
+	})
+	if err != nil {
+		m.checkErr(err, ErrorDatabase, sql)
+	}
+
+	return latest, err
+}
@@ -0,0 +1,60 @@
+package imessage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// ScriptRunner runs AppleScripts. Set Config.Runner to replace osascript,
+// for example with a fake in tests. Retries and timeouts are handled by the
+// caller; Run is called once per attempt and should return when ctx ends.
+type ScriptRunner interface {
+	// Run runs the scripts as one program. stdout is the script's result, and
+	// output is everything it printed (stdout and stderr). A non-nil error fails the attempt.
+	Run(ctx context.Context, scripts []string) (stdout, output string, err error)
+}
+
+// osascript is the default ScriptRunner. It runs scripts with path, or OSAScriptPath.
+// language is passed to osascript with -l; AppleScript is used if it's empty.
+type osascript struct {
+	path     string
+	language string
+}
+
+// Run runs the scripts with osascript, passing each one with -e.
+func (o osascript) Run(ctx context.Context, scripts []string) (string, string, error) {
+	arg := o.args(scripts)
+	cmd := exec.CommandContext(ctx, arg[0], arg[1:]...) //nolint:gosec
+
+	var out, stdout bytes.Buffer
+
+	cmd.Stdout = io.MultiWriter(&out, &stdout)
+	cmd.Stderr = &out
+
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), out.String(), fmt.Errorf("exec: %w: %v", err, out.String())
+	}
+
+	return stdout.String(), out.String(), nil
+}
+
+// args returns the osascript command line for the scripts.
+func (o osascript) args(scripts []string) []string {
+	arg := []string{o.path}
+	if o.path == "" {
+		arg[0] = OSAScriptPath
+	}
+
+	if o.language != "" {
+		arg = append(arg, "-l", o.language)
+	}
+
+	for _, s := range scripts {
+		arg = append(arg, "-e", s)
+	}
+
+	return arg
+}
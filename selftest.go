@@ -0,0 +1,128 @@
+package imessage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SelfTest errors.
+var (
+	ErrNoTestHandle = fmt.Errorf("no self-test handle; set SelfTestHandle or IgnoreHandles")
+	ErrSelfTest     = fmt.Errorf("self-test message not found in the database")
+	ErrSelfTestRecv = fmt.Errorf("self-test message was not received")
+)
+
+// selfTest is the message a running SelfTest is waiting to receive through the incoming watcher.
+type selfTest struct {
+	run      sync.Mutex // Held while SelfTest runs, so only one runs at a time.
+	lock     sync.Mutex // Protects text and received.
+	text     string
+	received chan struct{} // Closed when the message with text arrives.
+}
+
+// expectSelfTest sets the text of the self-test message, and returns a channel that is closed
+// when it is received. Pass an empty text when done waiting.
+func (m *Messages) expectSelfTest(text string) chan struct{} {
+	m.selfTest.lock.Lock()
+	defer m.selfTest.lock.Unlock()
+
+	m.selfTest.text = text
+	m.selfTest.received = make(chan struct{})
+
+	return m.selfTest.received
+}
+
+// selfTestReceived returns true if the message is the incoming copy of the self-test message.
+// It is checked before IgnoreHandles and the bindings, and never passed to the bindings.
+func (m *Messages) selfTestReceived(msg *Incoming) bool {
+	m.selfTest.lock.Lock()
+	defer m.selfTest.lock.Unlock()
+
+	if m.selfTest.text == "" || msg.FromMe || msg.Text != m.selfTest.text {
+		return false
+	}
+
+	m.DebugLog.Printf("received self-test message %d", msg.RowID)
+	close(m.selfTest.received)
+	m.selfTest.text = ""
+
+	return true
+}
+
+// SelfTest sends a message to SelfTestHandle (default is the first IgnoreHandles entry),
+// waits for it to show up in the database, then waits for Messages.app to record the
+// incoming copy and the watcher to read it. This checks that AppleScript can send messages,
+// and that the database can be read and is being watched. The incoming copy is read even
+// though it comes from an IgnoreHandles handle, and it is not passed to the bindings. It must
+// match IncomingFilter. The library must be started. Use a context with a deadline; Messages.app
+// may take several seconds to record a message. With DryRun, the message is not sent, so only
+// the send pipeline and the database are checked.
+func (m *Messages) SelfTest(ctx context.Context) error {
+	handle := m.SelfTestHandle
+	if handle == "" && len(m.IgnoreHandles) > 0 {
+		handle = m.IgnoreHandles[0]
+	}
+
+	if handle == "" {
+		return ErrNoTestHandle
+	} else if !m.isRunning() {
+		return ErrNotStarted
+	} else if err := m.Ready(); err != nil {
+		return err
+	}
+
+	m.selfTest.run.Lock()
+	defer m.selfTest.run.Unlock()
+
+	after, err := m.maxRowID(m.SQLPath)
+	if err != nil {
+		return err
+	}
+
+	text := "imessage self-test " + m.Clock.Now().Format(time.RFC3339Nano)
+	msg := m.prepare(Outgoing{ID: "self-test", To: handle, Text: text})
+	received := m.expectSelfTest(msg.Text)
+
+	defer m.expectSelfTest("")
+
+	if _, err := m.SendWait(ctx, msg); err != nil {
+		return err
+	} else if m.DryRun {
+		return nil
+	}
+
+	if err := m.waitSelfTestSent(ctx, msg, after); err != nil {
+		return err
+	}
+
+	select {
+	case <-received:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrSelfTestRecv, ctx.Err()) //nolint:errorlint
+	}
+}
+
+// waitSelfTestSent waits for the sent self-test message to show up in the database.
+func (m *Messages) waitSelfTestSent(ctx context.Context, msg Outgoing, after int64) error {
+	ticker := m.Clock.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	for {
+		if status, err := m.sentStatus(msg, after); err == nil && status.RowID != 0 {
+			if status.Failed {
+				return fmt.Errorf("%w: message %d failed to send", ErrSelfTest, status.RowID)
+			}
+
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ErrSelfTest, ctx.Err()) //nolint:errorlint
+		case <-ticker.Chan():
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package imessage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+func TestSelfTest(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{})
+	if err := m.SelfTest(context.Background()); !errors.Is(err, ErrNoTestHandle) {
+		t.Errorf("got error %v without a handle, expected ErrNoTestHandle", err)
+	}
+
+	m.SelfTestHandle = "+15551234567"
+	if err := m.SelfTest(context.Background()); !errors.Is(err, ErrNotStarted) {
+		t.Errorf("got error %v before Start, expected ErrNotStarted", err)
+	}
+
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	// With DryRun, only the send pipeline and the database are checked.
+	if err := m.SelfTest(context.Background()); err != nil {
+		t.Errorf("self-test failed: %v", err)
+	}
+}
+
+// echoRunner is a ScriptRunner that records each sent message in the test database, like
+// Messages.app. With echo, the incoming copy of a message sent to this account is recorded too.
+type echoRunner struct {
+	path string
+	echo bool
+}
+
+func (r *echoRunner) Run(_ context.Context, scripts []string) (string, string, error) {
+	conn, err := sqlite.OpenConn(r.path, 0)
+	if err != nil {
+		return "", "", err //nolint:wrapcheck
+	}
+
+	defer conn.Close()
+
+	fromMe := []bool{true}
+	if r.echo {
+		fromMe = append(fromMe, false)
+	}
+
+	for _, text := range sendText.FindAllStringSubmatch(strings.Join(scripts, "\n"), -1) {
+		for _, mine := range fromMe {
+			err := sqlitex.Exec(conn, `INSERT INTO message (guid, text, handle_id, is_from_me, service) `+
+				`VALUES (lower(hex(randomblob(16))), ?, 1, ?, 'iMessage')`, nil, text[1], mine)
+			if err != nil {
+				return "", "", err //nolint:wrapcheck
+			}
+
+			err = sqlitex.Exec(conn, `INSERT INTO chat_message_join (chat_id, message_id) VALUES (1, ?)`,
+				nil, conn.LastInsertRowID())
+			if err != nil {
+				return "", "", err //nolint:wrapcheck
+			}
+		}
+	}
+
+	return "", "", nil
+}
+
+// The self-test message is sent, then its incoming copy is read by the watcher, even
+// though it is from an IgnoreHandles handle. It is not passed to the bindings.
+func TestSelfTestReceived(t *testing.T) {
+	t.Parallel()
+
+	for _, echo := range []bool{true, false} {
+		m := newTestMessages(t, &Config{IgnoreHandles: []string{"+15551234567"}, SendDelay: time.Millisecond})
+		m.DryRun, m.Runner = false, &echoRunner{path: m.SQLPath, echo: echo}
+
+		bound := make(chan Incoming, 10) //nolint:gomnd
+		if err := m.IncomingChan(".*", bound); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := m.SelfTest(ctx)
+
+		cancel()
+		m.Stop()
+
+		switch {
+		case echo && err != nil:
+			t.Errorf("self-test failed: %v", err)
+		case !echo && !errors.Is(err, ErrSelfTestRecv):
+			t.Errorf("got error %v without an incoming copy, expected ErrSelfTestRecv", err)
+		case len(bound) > 0:
+			t.Errorf("self-test message was passed to the bindings: %v", <-bound)
+		}
+	}
+}
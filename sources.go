@@ -0,0 +1,218 @@
+package imessage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Source provides incoming messages. Set Config.Source to replace the default,
+// which watches the iMessage database(s) at SQLPath and SQLPaths. A custom Source
+// is useful for tests, or for reading messages from somewhere other than chat.db.
+type Source interface {
+	// Start begins delivering messages. Called by Messages.Start().
+	Start() error
+	// Messages returns the channel messages are delivered on. Called after Start.
+	Messages() <-chan Incoming
+	// Stop ends delivery, and closes the Messages channel. Called by Messages.Stop().
+	Stop()
+}
+
+// chatDB is the default Source. It watches the iMessage databases with fsnotify.
+type chatDB struct {
+	m        *Messages
+	stop     chan struct{}
+	messages chan Incoming // made by each Start, and closed by its watcher routine.
+	started  bool          // the backlog is only processed the first time.
+}
+
+// Start reads the current message ID from every database and starts the watcher routine.
+//
+//nolint:wrapcheck
+func (c *chatDB) Start() error {
+	backlog := !c.started && (c.m.ProcessBacklog || c.m.StartFromRowID > 0)
+
+	if !c.started {
+		if err := c.m.loadCursor(); err != nil {
+			return err
+		}
+	}
+
+	c.started = true
+
+	// These sources start before the newest message, so they are checked right away.
+	var check []*source
+
+	for _, src := range c.m.sources {
+		src.idLock.Lock()
+		resume := src.resume
+		src.resume = false
+
+		if !resume && backlog {
+			src.currentID = c.m.StartFromRowID
+		}
+
+		src.idLock.Unlock()
+
+		if !resume && !backlog {
+			if err := c.m.getCurrentID(src); err != nil {
+				return fmt.Errorf("%s: %w", src.path, err)
+			}
+		} else if _, err := c.m.maxRowID(src.path); err != nil { // Make sure it can be read.
+			return fmt.Errorf("%s: %w", src.path, err)
+		} else {
+			check = append(check, src)
+		}
+
+		c.m.DebugLog.Printf("starting with id %d: %s", src.currentID, src.path)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	for _, src := range c.m.sources {
+		if err := watcher.Add(filepath.Dir(src.path)); err != nil {
+			_ = watcher.Close()
+			return err
+		}
+	}
+
+	c.stop = make(chan struct{})
+	c.messages = make(chan Incoming, c.m.IncomingBuffer)
+
+	go func(stop chan struct{}, ready *readiness, inChan chan Incoming) {
+		for _, src := range check {
+			c.m.checkForNewMessages(src, inChan)
+		}
+
+		c.m.setReady(ready, nil)
+
+		c.m.fsnotifySQL(watcher, c.m.Clock.NewTicker(c.m.getInterval()), stop, inChan)
+		_ = watcher.Close()
+		close(inChan)
+	}(c.stop, c.m.ready, c.messages)
+
+	return nil
+}
+
+// Messages returns the channel new messages from the databases are sent to.
+func (c *chatDB) Messages() <-chan Incoming {
+	return c.messages
+}
+
+// Stop ends the watcher routine. The Messages channel is closed when it returns.
+func (c *chatDB) Stop() {
+	close(c.stop)
+}
+
+// source is a chat.db being watched for new messages. There is one for SQLPath,
+// and one for each of SQLPaths.
+type source struct {
+	path      string     // Path to the database file.
+	currentID int64      // Constantly growing
+	idLock    sync.Mutex // Protects currentID while the database is read.
+	checkLock sync.Mutex // Serializes checks, so rows are delivered once and in order.
+	resume    bool       // currentID was set with SetCurrentID before Start, so Start keeps it.
+	// editsSince is the newest edit or unsend date already delivered. -1 if it is not read yet.
+	editsSince int64
+	noEdits    bool // the database has no edit columns (before macOS Ventura).
+	noReplies  bool // the database has no threaded reply column (before macOS 11).
+	// failures is how many checks in a row could not read the database. retryAt is
+	// when the watcher tries again, even without a write event.
+	failures int
+	retryAt  time.Time
+}
+
+// These are the shortest and longest waits before re-checking a database that could not be read.
+const (
+	recoverMin = time.Second
+	recoverMax = time.Minute
+)
+
+// failed records a check that could not read the database, and returns how long to wait
+// before trying again. The wait doubles with each failure. Call with idLock held.
+func (s *source) failed(now time.Time) time.Duration {
+	wait := recoverMax
+	if s.failures < 6 { //nolint:gomnd // 2^6 seconds is more than recoverMax.
+		wait = recoverMin << s.failures
+	}
+
+	s.failures++
+	s.retryAt = now.Add(wait)
+
+	return wait
+}
+
+// retryDue returns true if the database could not be read, and it's time to try again.
+func (s *source) retryDue(now time.Time) bool {
+	s.idLock.Lock()
+	defer s.idLock.Unlock()
+
+	return s.failures > 0 && !now.Before(s.retryAt)
+}
+
+// newSources returns a source for every unique database path in the config.
+// The primary database (SQLPath) is always first.
+func newSources(config *Config) []*source {
+	sources := []*source{{path: config.SQLPath, editsSince: -1}}
+	seen := map[string]bool{filepath.Clean(config.SQLPath): true}
+
+	for _, path := range config.SQLPaths {
+		if path == "" || seen[filepath.Clean(path)] {
+			continue
+		}
+
+		seen[filepath.Clean(path)] = true
+		sources = append(sources, &source{path: path, editsSince: -1})
+	}
+
+	return sources
+}
+
+// CurrentID returns the row id of the newest message read from the database at SQLPath.
+// Messages after this one are delivered next. Save it to resume with SetCurrentID later.
+func (m *Messages) CurrentID() int64 {
+	src := m.primary()
+
+	src.idLock.Lock()
+	defer src.idLock.Unlock()
+
+	return src.currentID
+}
+
+// SetCurrentID changes where reading the database at SQLPath continues from: messages with a
+// row id greater than id are delivered next. Call it before Start to resume from a saved
+// CurrentID; Start then keeps it, instead of starting after the newest message.
+func (m *Messages) SetCurrentID(id int64) {
+	src := m.primary()
+	running := m.isRunning() // before idLock; Start holds runLock while it takes idLock.
+
+	src.idLock.Lock()
+	defer src.idLock.Unlock()
+
+	src.currentID = id
+	src.resume = !running
+}
+
+// primary returns the source for SQLPath.
+func (m *Messages) primary() *source {
+	return m.sources[0]
+}
+
+// sourcesIn returns the sources with a database file in dir.
+func (m *Messages) sourcesIn(dir string) []*source {
+	var list []*source
+
+	for _, src := range m.sources {
+		if filepath.Dir(filepath.Clean(src.path)) == filepath.Clean(dir) {
+			list = append(list, src)
+		}
+	}
+
+	return list
+}
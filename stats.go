@@ -0,0 +1,80 @@
+package imessage
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the library's counters. Get one with Messages.Stats().
+type Stats struct {
+	Received   int64         // Received is the number of incoming messages read from the database.
+	Sent       int64         // Sent is the number of outgoing messages sent successfully.
+	SendErrors int64         // SendErrors is the number of outgoing messages that failed to send.
+	Retries    int64         // Retries is the number of AppleScript attempts that were retries.
+	Checks     int64         // Checks is the number of times the database was checked for new messages.
+	CheckTime  time.Duration // CheckTime is the total time spent checking the database.
+	FileEvents int64         // FileEvents is the number of fsnotify write events that triggered a check.
+	Polls      int64         // Polls is the number of checks made by polling, after fsnotify failed.
+	Dropped    int64         // Dropped is the number of messages not sent to a full NonBlocking channel.
+	SendTime   time.Duration // SendTime is the total time spent sending messages (Sent + SendErrors).
+	// SendLatency is a cumulative histogram of send times. The keys are from SendLatencyBuckets,
+	// and each value is the number of sends that took less than or equal to that duration.
+	SendLatency map[time.Duration]int64
+}
+
+// SendLatencyBuckets are the upper bounds for the Stats.SendLatency histogram.
+//
+//nolint:gochecknoglobals,gomnd
+var SendLatencyBuckets = [...]time.Duration{
+	250 * time.Millisecond, 500 * time.Millisecond, time.Second,
+	2 * time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+}
+
+// counters are updated atomically by the routines. All fields are int64
+// and this struct is allocated on its own, so the fields are 64-bit aligned.
+type counters struct {
+	received   int64
+	sent       int64
+	sendErrors int64
+	retries    int64
+	checks     int64
+	checkTime  int64
+	fileEvents int64
+	polls      int64
+	dropped    int64
+	sendTime   int64
+	sendBucket [len(SendLatencyBuckets)]int64
+}
+
+// observeSend adds a send duration to the latency histogram.
+func (c *counters) observeSend(elapsed time.Duration) {
+	atomic.AddInt64(&c.sendTime, int64(elapsed))
+
+	for i, bucket := range SendLatencyBuckets {
+		if elapsed <= bucket {
+			atomic.AddInt64(&c.sendBucket[i], 1)
+		}
+	}
+}
+
+// Stats returns a snapshot of the message counters. Safe to call any time.
+func (m *Messages) Stats() Stats {
+	latency := make(map[time.Duration]int64, len(SendLatencyBuckets))
+	for i, bucket := range SendLatencyBuckets {
+		latency[bucket] = atomic.LoadInt64(&m.stats.sendBucket[i])
+	}
+
+	return Stats{
+		Received:    atomic.LoadInt64(&m.stats.received),
+		Sent:        atomic.LoadInt64(&m.stats.sent),
+		SendErrors:  atomic.LoadInt64(&m.stats.sendErrors),
+		Retries:     atomic.LoadInt64(&m.stats.retries),
+		Checks:      atomic.LoadInt64(&m.stats.checks),
+		CheckTime:   time.Duration(atomic.LoadInt64(&m.stats.checkTime)),
+		FileEvents:  atomic.LoadInt64(&m.stats.fileEvents),
+		Polls:       atomic.LoadInt64(&m.stats.polls),
+		Dropped:     atomic.LoadInt64(&m.stats.dropped),
+		SendTime:    time.Duration(atomic.LoadInt64(&m.stats.sendTime)),
+		SendLatency: latency,
+	}
+}
@@ -0,0 +1,191 @@
+package imessage
+
+import (
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+)
+
+// DefaultStatusTimeout is the default for Config.StatusTimeout.
+const DefaultStatusTimeout = 5 * time.Minute
+
+// statusInterval is how often the database is checked for a sent message's status.
+const statusInterval = 2 * time.Second
+
+// How long, and how often, the database is checked for a sent message with VerifySends.
+const (
+	verifyWait     = time.Second
+	verifyInterval = 100 * time.Millisecond
+)
+
+// Status is the delivery status of a sent message, provided to Outgoing.Status.
+type Status struct {
+	ID          string    `json:"id"`           // ID is the Outgoing message ID.
+	To          string    `json:"to"`           // To is the Outgoing message recipient.
+	RowID       int64     `json:"row_id"`       // RowID is the sent message's database row id. 0 if not found.
+	GUID        string    `json:"guid"`         // GUID is the sent message's unique identifier.
+	Delivered   bool      `json:"delivered"`    // Delivered is true once the recipient's device has the message.
+	DeliveredAt time.Time `json:"delivered_at"` // DeliveredAt is when the message was delivered.
+	Read        bool      `json:"read"`         // Read is true once the recipient read it. Needs read receipts.
+	ReadAt      time.Time `json:"read_at"`      // ReadAt is when the message was read.
+	Failed      bool      `json:"failed"`       // Failed is true if Messages.app could not deliver the message.
+	// TimedOut is true if StatusTimeout passed before the message was read or failed.
+	// This is the last Status for the message.
+	TimedOut bool `json:"timed_out"`
+}
+
+// statusAfter returns the highest database row id, if the message has a Status callback
+// or VerifySends is enabled. Call this right before sending the message.
+func (m *Messages) statusAfter(msg Outgoing) int64 {
+	if msg.Status == nil && !m.VerifySends {
+		return 0
+	}
+
+	after, err := m.maxRowID(m.SQLPath)
+	if err != nil {
+		m.checkErr(err, ErrorDatabase, "reading current id for message status")
+	}
+
+	return after
+}
+
+// confirmSent returns true if the database has a message from this account to the recipient
+// with the message's text after the `after` row id, that did not fail. Messages.app may take a moment to write it.
+func (m *Messages) confirmSent(msg Outgoing, after int64) bool {
+	for deadline := m.Clock.Now().Add(verifyWait); ; m.Clock.Sleep(verifyInterval) {
+		status, err := m.sentStatus(msg, after)
+		if err == nil && status.RowID != 0 {
+			if status.Failed {
+				m.ErrorLog.Printf("message %s to %s failed in Messages.app", msg.ID, msg.To)
+			}
+
+			return !status.Failed
+		}
+
+		if err != nil || m.Clock.Now().After(deadline) {
+			m.ErrorLog.Printf("message %s to %s was sent, but not found in the database", msg.ID, msg.To)
+			return false
+		}
+	}
+}
+
+// trackStatus watches the database for a sent message, and runs its Status callback each
+// time the status changes. Stops when the message is read or fails, or StatusTimeout passes.
+// after is the highest row id before the message was sent; the message is the first
+// one sent to the recipient after that.
+func (m *Messages) trackStatus(msg Outgoing, after int64) {
+	ticker := m.Clock.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	timeout := m.Clock.NewTimer(m.StatusTimeout)
+	defer timeout.Stop()
+
+	last := Status{ID: msg.ID, To: msg.To}
+
+	for {
+		select {
+		case <-timeout.Chan():
+			last.TimedOut = true
+			msg.Status(&last)
+
+			return
+		case <-ticker.Chan():
+		}
+
+		status, err := m.sentStatus(msg, after)
+		if err != nil || status == last {
+			continue
+		}
+
+		last = status
+		msg.Status(&status)
+
+		if status.Read || status.Failed {
+			return
+		}
+	}
+}
+
+// sentStatus returns the current status of a sent message. It is the first message
+// from this account after the `after` row id, in a chat or to a handle matching the
+// recipient, with the same text. Files without a caption match any text.
+//
+//nolint:wrapcheck
+func (m *Messages) sentStatus(msg Outgoing, after int64) (Status, error) {
+	sql := `SELECT message.rowid as rowid, message.guid as guid, message.is_delivered as is_delivered, ` +
+		`message.date_delivered as date_delivered, message.is_read as is_read, ` +
+		`message.date_read as date_read, message.error as error, message.text as text, ` +
+		`message.attributedBody as attributed_body ` +
+		`FROM message LEFT JOIN handle ON message.handle_id = handle.ROWID ` +
+		`LEFT JOIN chat_message_join ON chat_message_join.message_id = message.ROWID ` +
+		`LEFT JOIN chat ON chat.ROWID = chat_message_join.chat_id ` +
+		`WHERE message.is_from_me = 1 AND message.rowid > $after AND ` +
+		`(handle.id = $to OR chat.guid = $to OR chat.chat_identifier = $to OR chat.display_name = $to) ` +
+		`ORDER BY message.rowid ASC`
+
+	status := Status{ID: msg.ID, To: msg.To}
+
+	dbase, err := m.getDB()
+	if err != nil {
+		return status, err
+	}
+
+	defer m.closeDB(dbase)
+
+	query, _, err := dbase.PrepareTransient(sql)
+	if err != nil {
+		return status, err
+	}
+
+	// Files without a caption have no text to compare.
+	body := strings.TrimSpace(msg.body())
+	if msg.File {
+		body = ""
+	}
+
+	err = m.stepRows(query, func(query *sqlite.Stmt) {
+		query.SetInt64("$after", after)
+		query.SetText("$to", msg.recipient())
+		status.RowID = 0
+	}, func(query *sqlite.Stmt) {
+		if status.RowID != 0 || (body != "" && sentText(query) != body) {
+			return // Another message sent to the same recipient.
+		}
+
+		status.RowID = query.GetInt64("rowid")
+		status.GUID = query.GetText("guid")
+		status.Delivered = query.GetInt64("is_delivered") == 1
+		status.DeliveredAt = appleTime(query.GetInt64("date_delivered"))
+		status.Read = query.GetInt64("is_read") == 1
+		status.ReadAt = appleTime(query.GetInt64("date_read"))
+		status.Failed = query.GetInt64("error") != 0
+	})
+	if err != nil {
+		m.checkErr(err, ErrorDatabase, sql)
+	}
+
+	return status, err
+}
+
+// sentText returns the trimmed text of a row from the sentStatus query. Newer macOS
+// versions often leave the text column empty, so it is read from the attributedBody.
+func sentText(query *sqlite.Stmt) string {
+	if text := strings.TrimSpace(query.GetText("text")); text != "" {
+		return text
+	}
+
+	length := query.GetLen("attributed_body")
+	if length == 0 {
+		return ""
+	}
+
+	blob := make([]byte, length)
+	query.GetBytes("attributed_body", blob)
+
+	if body, err := parseAttributedBody(blob); err == nil {
+		return strings.TrimSpace(body.Text)
+	}
+
+	return ""
+}
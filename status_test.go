@@ -0,0 +1,39 @@
+package imessage
+
+import "testing"
+
+// The sent message is found by its text, not only by its recipient.
+func TestSentStatus(t *testing.T) {
+	t.Parallel()
+
+	m := newTestMessages(t, &Config{})
+	addTestMessage(t, m.SQLPath, 1, 1, "from them", 1)
+	addTestMessage(t, m.SQLPath, 1, 1, "sent by another app", 2) //nolint:gomnd
+	addTestMessage(t, m.SQLPath, 1, 1, "hi there", 3)            //nolint:gomnd
+	addTestMessage(t, m.SQLPath, 1, 1, "", 4)                    //nolint:gomnd
+	execTestDB(t, m.SQLPath, `UPDATE message SET is_from_me = 1 WHERE rowid > 1;
+		UPDATE message SET text = NULL, attributedBody = X'`+helloBody+`' WHERE rowid = 4;`)
+
+	tests := []struct {
+		msg    Outgoing
+		expect int64
+	}{
+		{msg: Outgoing{To: "+15551234567", Text: "hi there"}, expect: 3},
+		{msg: Outgoing{To: "+15551234567", Text: "Hello"}, expect: 4},
+		{msg: Outgoing{To: "iMessage;-;+15551234567", Text: " hi there\n"}, expect: 3},
+		{msg: Outgoing{To: "+15551234567", Text: "never sent"}, expect: 0},
+		{msg: Outgoing{To: "+15551234567", Text: "from them"}, expect: 0},
+		{msg: Outgoing{To: "+15551234567", Text: "~/photo.jpg", File: true}, expect: 2},
+	}
+
+	for _, test := range tests {
+		status, err := m.sentStatus(test.msg, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status.RowID != test.expect {
+			t.Errorf("%q to %s matched message %d, expected %d", test.msg.Text, test.msg.To, status.RowID, test.expect)
+		}
+	}
+}
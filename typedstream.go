@@ -0,0 +1,488 @@
+package imessage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// The attributedBody column holds an NSAttributedString archived as an Apple (NeXT) typedstream.
+// A typedstream is a self-describing sequence of values: every group of values is preceded by
+// an Objective-C type encoding, so it can be decoded without knowing how each class encodes itself.
+
+// These are the special head bytes in a typedstream. Anything else is a small integer.
+const (
+	tsInt2      = -127 // a 2 byte integer follows.
+	tsInt4      = -126 // a 4 byte integer follows.
+	tsFloat     = -125 // a 4 or 8 byte float follows.
+	tsNew       = -124 // a new object, class or string follows.
+	tsNil       = -123 // a nil object, class or string.
+	tsEnd       = -122 // the end of an object's contents.
+	tsFirstRef  = -110 // reference numbers start here.
+	tsVersion   = 4
+	tsSignature = "streamtyped"
+)
+
+// mentionAttribute is the attribute key Messages.app uses for confirmed @mentions.
+// The attribute value is the handle that was mentioned.
+const mentionAttribute = "__kIMMentionConfirmedMention"
+
+var errTypedStream = fmt.Errorf("invalid typedstream")
+
+// tsObject is a decoded object: its class name and the values it archived, in order.
+type tsObject struct {
+	Class  string
+	Values []interface{}
+}
+
+// typedStream decodes a little-endian typedstream.
+type typedStream struct {
+	data    []byte
+	pos     int
+	strings []string      // shared strings: type encodings and class names.
+	objects []interface{} // shared objects: classes, objects and C strings.
+}
+
+// attributedBody is the useful content of an attributedBody blob.
+type attributedBody struct {
+	Text     string
+	Mentions []string // handles that were @mentioned.
+}
+
+// parseAttributedBody decodes an attributedBody blob from the message table.
+func parseAttributedBody(blob []byte) (*attributedBody, error) {
+	stream := &typedStream{data: blob}
+
+	root, err := stream.decode()
+	if err != nil {
+		return nil, err
+	}
+
+	body := &attributedBody{}
+	if len(root.Values) == 0 {
+		return body, nil
+	}
+
+	if str, ok := root.Values[0].(*tsObject); ok && str != nil && len(str.Values) > 0 {
+		body.Text, _ = str.Values[0].(string)
+	}
+
+	// The rest of the values are attribute runs: index, length, and an attribute dictionary.
+	for _, val := range root.Values[1:] {
+		if dict, ok := val.(*tsObject); ok && dict != nil {
+			body.Mentions = append(body.Mentions, dict.attribute(mentionAttribute)...)
+		}
+	}
+
+	return body, nil
+}
+
+// attribute returns the string values for a key in an archived NSDictionary.
+// Dictionaries are archived as a count followed by alternating keys and values.
+func (o *tsObject) attribute(key string) []string {
+	var found []string
+
+	for i := 1; i+1 < len(o.Values); i += 2 {
+		name, _ := o.Values[i].(*tsObject)
+		val, _ := o.Values[i+1].(*tsObject)
+
+		if name.string() == key && val.string() != "" {
+			found = append(found, val.string())
+		}
+	}
+
+	return found
+}
+
+// string returns the contents of an archived NSString, or an empty string.
+func (o *tsObject) string() string {
+	if o == nil || len(o.Values) == 0 || !strings.HasSuffix(o.Class, "String") {
+		return ""
+	}
+
+	str, _ := o.Values[0].(string)
+
+	return str
+}
+
+// decode reads the stream header and the root object.
+func (t *typedStream) decode() (*tsObject, error) {
+	if version, err := t.byte(); err != nil || version != tsVersion {
+		return nil, fmt.Errorf("%w: bad version", errTypedStream)
+	}
+
+	if sig, err := t.unsharedString(); err != nil || sig != tsSignature {
+		return nil, fmt.Errorf("%w: bad signature", errTypedStream)
+	}
+
+	if _, err := t.integer(); err != nil { // system version.
+		return nil, err
+	}
+
+	values, err := t.group()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%w: no root object", errTypedStream)
+	}
+
+	root, ok := values[0].(*tsObject)
+	if !ok || root == nil {
+		return nil, fmt.Errorf("%w: root is not an object", errTypedStream)
+	}
+
+	return root, nil
+}
+
+// byte reads one byte.
+func (t *typedStream) byte() (byte, error) {
+	if t.pos >= len(t.data) {
+		return 0, fmt.Errorf("%w: unexpected end of data", errTypedStream)
+	}
+
+	t.pos++
+
+	return t.data[t.pos-1], nil
+}
+
+// bytes reads count raw bytes.
+func (t *typedStream) bytes(count int) ([]byte, error) {
+	if count < 0 || t.pos+count > len(t.data) {
+		return nil, fmt.Errorf("%w: unexpected end of data", errTypedStream)
+	}
+
+	t.pos += count
+
+	return t.data[t.pos-count : t.pos], nil
+}
+
+// head reads a head byte, and the extended integer that follows it, if any.
+func (t *typedStream) head() (int64, error) {
+	head, err := t.byte()
+	if err != nil {
+		return 0, err
+	}
+
+	switch int8(head) {
+	case tsInt2:
+		b, err := t.bytes(2) //nolint:gomnd
+		if err != nil {
+			return 0, err
+		}
+
+		return int64(int16(binary.LittleEndian.Uint16(b))), nil
+	case tsInt4:
+		b, err := t.bytes(4) //nolint:gomnd
+		if err != nil {
+			return 0, err
+		}
+
+		return int64(int32(binary.LittleEndian.Uint32(b))), nil
+	default:
+		return int64(int8(head)), nil
+	}
+}
+
+// integer reads an integer value.
+func (t *typedStream) integer() (int64, error) {
+	return t.head()
+}
+
+// float reads a floating point value. Whole numbers may be stored as integers.
+func (t *typedStream) float(size int) (float64, error) {
+	if t.pos < len(t.data) && int8(t.data[t.pos]) == tsFloat {
+		t.pos++
+
+		b, err := t.bytes(size)
+		if err != nil {
+			return 0, err
+		}
+
+		if size == 4 { //nolint:gomnd
+			return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+		}
+
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	}
+
+	val, err := t.integer()
+
+	return float64(val), err
+}
+
+// unsharedString reads a length-prefixed string.
+func (t *typedStream) unsharedString() (string, error) {
+	length, err := t.integer()
+	if err != nil {
+		return "", err
+	}
+
+	b, err := t.bytes(int(length))
+
+	return string(b), err
+}
+
+// sharedString reads a new string, or a reference to one read before.
+func (t *typedStream) sharedString() (string, error) {
+	head, err := t.head()
+	if err != nil {
+		return "", err
+	}
+
+	switch head {
+	case tsNil:
+		return "", nil
+	case tsNew:
+		str, err := t.unsharedString()
+		if err != nil {
+			return "", err
+		}
+
+		t.strings = append(t.strings, str)
+
+		return str, nil
+	default:
+		idx := int(head - tsFirstRef)
+		if idx < 0 || idx >= len(t.strings) {
+			return "", fmt.Errorf("%w: bad string reference %d", errTypedStream, idx)
+		}
+
+		return t.strings[idx], nil
+	}
+}
+
+// cString reads a C string. These are shared strings that are also stored as shared objects.
+func (t *typedStream) cString() (string, error) {
+	head, err := t.head()
+	if err != nil {
+		return "", err
+	}
+
+	switch head {
+	case tsNil:
+		return "", nil
+	case tsNew:
+		str, err := t.sharedString()
+		if err != nil {
+			return "", err
+		}
+
+		t.objects = append(t.objects, str)
+
+		return str, nil
+	default:
+		str, _ := t.reference(head).(string)
+		return str, nil
+	}
+}
+
+// reference returns a shared object read before, or nil if it does not exist.
+func (t *typedStream) reference(head int64) interface{} {
+	if idx := int(head - tsFirstRef); idx >= 0 && idx < len(t.objects) {
+		return t.objects[idx]
+	}
+
+	return nil
+}
+
+// class reads a class and its superclasses, and returns the class name.
+func (t *typedStream) class() (string, error) {
+	head, err := t.head()
+	if err != nil {
+		return "", err
+	}
+
+	switch head {
+	case tsNil:
+		return "", nil
+	case tsNew:
+		name, err := t.sharedString()
+		if err != nil {
+			return "", err
+		}
+
+		if _, err := t.integer(); err != nil { // class version.
+			return "", err
+		}
+
+		t.objects = append(t.objects, name)
+
+		_, err = t.class() // superclass; unused.
+
+		return name, err
+	default:
+		name, _ := t.reference(head).(string)
+		return name, nil
+	}
+}
+
+// object reads an object and its contents.
+func (t *typedStream) object() (*tsObject, error) {
+	head, err := t.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch head {
+	case tsNil:
+		return nil, nil
+	case tsNew:
+	default:
+		obj, _ := t.reference(head).(*tsObject)
+		return obj, nil
+	}
+
+	obj := &tsObject{}
+	t.objects = append(t.objects, obj)
+
+	if obj.Class, err = t.class(); err != nil {
+		return nil, err
+	}
+
+	for {
+		if t.pos >= len(t.data) {
+			return nil, fmt.Errorf("%w: unterminated object", errTypedStream)
+		}
+
+		if int8(t.data[t.pos]) == tsEnd {
+			t.pos++
+			return obj, nil
+		}
+
+		values, err := t.group()
+		if err != nil {
+			return nil, err
+		}
+
+		obj.Values = append(obj.Values, values...)
+	}
+}
+
+// group reads a type encoding and the values it describes.
+func (t *typedStream) group() ([]interface{}, error) {
+	encoding, err := t.sharedString()
+	if err != nil {
+		return nil, err
+	}
+
+	var values []interface{}
+
+	for len(encoding) > 0 {
+		var val interface{}
+
+		val, encoding, err = t.value(encoding)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, val)
+	}
+
+	return values, nil
+}
+
+// value reads the value for the first type in encoding, and returns the remaining encoding.
+func (t *typedStream) value(encoding string) (interface{}, string, error) {
+	kind, rest := encoding[0], encoding[1:]
+
+	switch kind {
+	case '@', '#':
+		obj, err := t.object()
+		return obj, rest, err
+	case '+':
+		str, err := t.unsharedString()
+		return str, rest, err
+	case '*':
+		str, err := t.cString()
+		return str, rest, err
+	case '%', ':':
+		str, err := t.sharedString()
+		return str, rest, err
+	case 'f':
+		val, err := t.float(4) //nolint:gomnd
+		return val, rest, err
+	case 'd':
+		val, err := t.float(8) //nolint:gomnd
+		return val, rest, err
+	case 'c', 'C', 's', 'S', 'i', 'I', 'l', 'L', 'q', 'Q', 'B':
+		val, err := t.integer()
+		return val, rest, err
+	case '[':
+		return t.array(rest)
+	case '{':
+		return t.structure(rest)
+	default:
+		return nil, "", fmt.Errorf("%w: unsupported type %q", errTypedStream, kind)
+	}
+}
+
+// array reads an array like [16c]. Arrays of chars are read as strings.
+func (t *typedStream) array(encoding string) (interface{}, string, error) {
+	var count int
+
+	for len(encoding) > 0 && encoding[0] >= '0' && encoding[0] <= '9' {
+		count = count*10 + int(encoding[0]-'0') //nolint:gomnd
+		encoding = encoding[1:]
+
+		// Every element takes at least one byte. This also keeps count from overflowing.
+		if count > len(t.data)-t.pos {
+			return nil, "", fmt.Errorf("%w: array is longer than the data", errTypedStream)
+		}
+	}
+
+	end := strings.IndexByte(encoding, ']')
+	if end < 1 {
+		return nil, "", fmt.Errorf("%w: bad array type", errTypedStream)
+	}
+
+	elem, rest := encoding[:end], encoding[end+1:]
+
+	if elem == "c" || elem == "C" {
+		b, err := t.bytes(count)
+		return string(b), rest, err
+	}
+
+	values := make([]interface{}, count)
+
+	for i := range values {
+		var err error
+		if values[i], _, err = t.value(elem); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return values, rest, nil
+}
+
+// structure reads a struct like {CGPoint=dd}.
+func (t *typedStream) structure(encoding string) (interface{}, string, error) {
+	end := strings.IndexByte(encoding, '}')
+	if end < 0 {
+		return nil, "", fmt.Errorf("%w: bad struct type", errTypedStream)
+	}
+
+	fields, rest := encoding[:end], encoding[end+1:]
+	if eq := strings.IndexByte(fields, '='); eq >= 0 {
+		fields = fields[eq+1:]
+	}
+
+	var values []interface{}
+
+	for len(fields) > 0 {
+		var (
+			val interface{}
+			err error
+		)
+
+		if val, fields, err = t.value(fields); err != nil {
+			return nil, "", err
+		}
+
+		values = append(values, val)
+	}
+
+	return values, rest, nil
+}
@@ -0,0 +1,111 @@
+package imessage
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// attributedBody blobs as Messages.app stores them in the message table.
+//
+//nolint:lll
+const (
+	// "Hello", one attribute run.
+	helloBody = "040b73747265616d747970656481e803840140848484124e5341747472696275746564537472696e67008484084e534f626a656374008592848484084e53537472696e67019484012b0548656c6c6f86840269490105928484840c4e5344696374696f6e617279009484016901928496961d5f5f6b494d4d657373616765506172744174747269627574654e616d658692848484084e534e756d626572008484074e5356616c7565009484012a84999900868686"
+	// "Hey @Bob 👋", with @Bob a confirmed mention of bob@example.com. Three attribute runs.
+	mentionBody = "040b73747265616d747970656481e803840140848484124e5341747472696275746564537472696e67008484084e534f626a656374008592848484084e53537472696e67019484012b0d4865792040426f6220f09f918b86840269490104928484840c4e5344696374696f6e617279009484016901928496961d5f5f6b494d4d657373616765506172744174747269627574654e616d658692848484084e534e756d626572008484074e5356616c7565009484012a8499990086869702049284989902928496961d5f5f6b494d4d657373616765506172744174747269627574654e616d658692849b9c8499990086928496961c5f5f6b494d4d656e74696f6e436f6e6669726d65644d656e74696f6e86928496960f626f62406578616d706c652e636f6d86869703039284989901928496961d5f5f6b494d4d657373616765506172744174747269627574654e616d658692849b9c84999900868686"
+)
+
+func testBlob(t *testing.T, hexBlob string) []byte {
+	t.Helper()
+
+	blob, err := hex.DecodeString(hexBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return blob
+}
+
+func TestParseAttributedBody(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		blob     string
+		text     string
+		mentions []string
+	}{
+		{"hello", helloBody, "Hello", nil},
+		{"mention", mentionBody, "Hey @Bob 👋", []string{"bob@example.com"}},
+	}
+
+	for _, test := range tests {
+		body, err := parseAttributedBody(testBlob(t, test.blob))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if body.Text != test.text {
+			t.Errorf("%s: text = %q, want %q", test.name, body.Text, test.text)
+		}
+
+		if len(body.Mentions) != len(test.mentions) {
+			t.Fatalf("%s: mentions = %q, want %q", test.name, body.Mentions, test.mentions)
+		}
+
+		for i := range test.mentions {
+			if body.Mentions[i] != test.mentions[i] {
+				t.Errorf("%s: mentions = %q, want %q", test.name, body.Mentions, test.mentions)
+			}
+		}
+	}
+}
+
+func TestParseAttributedBodyInvalid(t *testing.T) {
+	t.Parallel()
+
+	header := "040b73747265616d747970656481e803" // version, signature, system version.
+	encoding := func(enc string) string {
+		return header + "84" + hex.EncodeToString([]byte{byte(len(enc))}) + hex.EncodeToString([]byte(enc))
+	}
+
+	tests := map[string]string{
+		"empty":           "",
+		"bad version":     "05" + helloBody[2:],
+		"bad signature":   "040b73747265616d747970656f",
+		"huge array":      encoding("[9999999999999999999@]") + "00",
+		"long array":      encoding("[100i]") + "0102",
+		"long char array": encoding("[100c]") + "0102",
+		"bad array":       encoding("[5"),
+		"bad struct":      encoding("{CGPoint=dd"),
+		"bad type":        encoding("x") + "00",
+		"no root object":  encoding("i") + "00",
+		"bad reference":   header + "9f",
+	}
+
+	for name, blob := range tests {
+		if _, err := parseAttributedBody(testBlob(t, blob)); !errors.Is(err, errTypedStream) {
+			t.Errorf("%s: error = %v, want %v", name, err, errTypedStream)
+		}
+	}
+}
+
+// Damaged blobs must return an error, or decode, but never panic.
+func TestParseAttributedBodyDamaged(t *testing.T) {
+	t.Parallel()
+
+	for _, hexBlob := range []string{helloBody, mentionBody} {
+		blob := testBlob(t, hexBlob)
+
+		for i := range blob {
+			_, _ = parseAttributedBody(blob[:i]) // truncated.
+
+			for _, b := range []byte{0x00, 0x01, 0x39, 0x40, 0x5b, 0x7f, 0x81, 0x82, 0x84, 0x85, 0x86, 0x92, 0xff} {
+				damaged := append([]byte{}, blob...)
+				damaged[i] = b
+				_, _ = parseAttributedBody(damaged)
+			}
+		}
+	}
+}
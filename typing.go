@@ -0,0 +1,52 @@
+package imessage
+
+// typingTime is how long the typing indicator shows before a ShowTyping message is sent.
+const typingTime = "2" // seconds, for an AppleScript delay.
+
+// SendTyping shows the typing indicator in a one-on-one conversation. Pass in a handle,
+// or a ChatGUID from an Incoming message. The conversation is opened in Messages.app (and
+// created if it does not exist yet), and a space is typed into the message field. The
+// indicator shows until the next message is sent with ShowTyping, or the field is cleared.
+// Group chats return ErrUnsupportedChat, because AppleScript cannot open a group chat.
+func (m *Messages) SendTyping(to string) error {
+	chatGUID, err := m.chatGUID(to, ServiceIMessage)
+	if err != nil {
+		return err
+	}
+
+	arg, err := typingScript(chatGUID)
+	if err != nil {
+		return err
+	}
+
+	if sent, errs := m.RunAppleScript(arg); !sent && len(errs) > 0 {
+		return errs[0]
+	}
+
+	m.Clock.Sleep(m.SendDelay)
+
+	return nil
+}
+
+// typingScript returns the AppleScript that opens a conversation and starts typing in it.
+func typingScript(chatGUID string) ([]string, error) {
+	openChat, err := openChatScript(chatGUID)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(openChat,
+		`delay 1`, // wait for the conversation window to open.
+		`tell application "System Events" to tell process "Messages" to keystroke " "`,
+	), nil
+}
+
+// clearTypingScript returns the AppleScript that empties the message field, which
+// stops the typing indicator. Run it after typingScript, while the conversation is open.
+func clearTypingScript() []string {
+	return []string{
+		`delay ` + typingTime,
+		`tell application "System Events" to tell process "Messages" to keystroke "a" using command down`,
+		`tell application "System Events" to tell process "Messages" to key code 51`, // delete.
+	}
+}
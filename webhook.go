@@ -0,0 +1,97 @@
+package imessage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DefaultWebhookTimeout is the default for Webhook.Timeout.
+const DefaultWebhookTimeout = 10 * time.Second
+
+// ErrWebhookStatus is returned when a webhook responds with a non-2xx status code.
+var ErrWebhookStatus = fmt.Errorf("unexpected webhook response status")
+
+// Webhook is an HTTP endpoint that incoming messages are posted to. See ForwardToWebhook.
+type Webhook struct {
+	URL     string        // URL receives a POST with each message as JSON.
+	Header  http.Header   // Header is added to each request. Content-Type is set to application/json.
+	Timeout time.Duration // Timeout is for each request. Default is DefaultWebhookTimeout.
+	// Retries is the most attempts for each message. Retries back off exponentially,
+	// starting at Config.RetryDelay. 0 uses Config.Retries.
+	Retries int
+	Client  *http.Client // Client sends the requests. Default is http.DefaultClient.
+}
+
+// ForwardToWebhook posts every incoming message matching `match` to a webhook as JSON.
+// This is a prebuilt IncomingCall, so match and opts work the same way, and the
+// binding is removed with RemoveCall(match). Failed posts are sent to the Errors() channel.
+func (m *Messages) ForwardToWebhook(hook Webhook, match string, opts ...BindOption) error {
+	if hook.Timeout <= 0 {
+		hook.Timeout = DefaultWebhookTimeout
+	}
+
+	if hook.Retries <= 0 {
+		hook.Retries = m.Retries
+	}
+
+	if hook.Client == nil {
+		hook.Client = http.DefaultClient
+	}
+
+	return m.IncomingCall(match, func(msg Incoming) {
+		m.checkErr(m.postWebhook(&hook, &msg), ErrorWebhook, "posting message to "+hook.URL)
+	}, opts...)
+}
+
+// postWebhook posts a message to a webhook, retrying with backoff on failure.
+func (m *Messages) postWebhook(hook *Webhook, msg *Incoming) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("encoding message: %w", err)
+	}
+
+	for i := 0; ; i++ {
+		if err = hook.post(body); err == nil || i+1 >= hook.Retries {
+			return err
+		}
+
+		m.DebugLog.Printf("webhook failed, retrying in %v: %v", m.RetryDelay<<i, err)
+		m.Clock.Sleep(m.RetryDelay << i)
+	}
+}
+
+// post makes one webhook request.
+func (hook *Webhook) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hook.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	for key, values := range hook.Header {
+		req.Header[key] = values
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := hook.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %s", ErrWebhookStatus, resp.Status)
+	}
+
+	return nil
+}